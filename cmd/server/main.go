@@ -2,16 +2,26 @@ package main
 
 import (
 	"context"
+	"errors"
+	"expvar"
 	"gossip/internal/adapters/postgres"
 	"gossip/internal/chat"
 	"gossip/internal/config"
 	"gossip/internal/repository"
 	"gossip/internal/router"
+	"gossip/internal/utils/ratelimit"
 	"log"
 	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
+// must stay under the kill timeout in fly.toml
+const SHUTDOWN_TIMEOUT = 20 * time.Second
+
 func main() {
 	config, err := config.Init()
 	if err != nil {
@@ -32,7 +42,25 @@ func main() {
 		PgPool: pgPool,
 	}
 
-	chatService, err := chat.NewService(repository)
+	broadcaster := postgres.NewBroadcaster(pgPool, chat.BROADCAST_CHANNEL)
+
+	chatService, err := chat.NewService(repository, broadcaster, chat.Options{
+		SendQueueSize:  config.ChatSendQueueSize,
+		OverflowPolicy: config.ChatOverflowPolicy,
+		WriteWait:      config.ChatWriteWait,
+		PongWait:       config.ChatPongWait,
+		PingPeriod:     config.ChatPingPeriod,
+		UserRate: ratelimit.Params{
+			Interval:     config.ChatUserRateInterval,
+			Burst:        config.ChatUserBurst,
+			MuteAfter:    config.ChatMuteAfter,
+			MuteDuration: config.ChatMuteDuration,
+		},
+		RoomRate: ratelimit.Params{
+			Interval: config.ChatRoomRateInterval,
+			Burst:    config.ChatRoomBurst,
+		},
+	})
 	if err != nil {
 		log.Fatal(err.Error())
 	}
@@ -40,13 +68,73 @@ func main() {
 	router, err := (&router.Router{
 		Repository:  repository,
 		ChatService: chatService,
+		AuthRate: ratelimit.Params{
+			Interval:     config.AuthRateInterval,
+			Burst:        config.AuthBurst,
+			MuteAfter:    config.AuthMuteAfter,
+			MuteDuration: config.AuthMuteDuration,
+		},
+		ClientIPHeader: config.ClientIPHeader,
 	}).Init()
 	if err != nil {
 		log.Fatal(err.Error())
 	}
 
-	slog.Info("server is running", "address", config.ServerAddress)
-	if err := http.ListenAndServe(config.ServerAddress, router); err != nil {
+	server := &http.Server{
+		Addr:    config.ServerAddress,
+		Handler: router,
+	}
+	serverErrors := make(chan error, 1)
+	go func() {
+		slog.Info("server is running", "address", config.ServerAddress)
+		serverErrors <- server.ListenAndServe()
+	}()
+
+	// expvar exposes memstats and the command line, so it is only served on
+	// an address kept off the public internet, such as localhost:6060
+	if config.DebugAddress != "" {
+		debugServer := &http.Server{
+			Addr:    config.DebugAddress,
+			Handler: expvar.Handler(),
+		}
+		go func() {
+			slog.Info("debug server is running", "address", config.DebugAddress)
+			err := debugServer.ListenAndServe()
+			if !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("debug server error", "error", err.Error())
+			}
+		}()
+		defer debugServer.Close()
+	}
+
+	signals, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	select {
+	case err := <-serverErrors:
 		log.Fatal(err.Error())
+	case <-signals.Done():
+	}
+
+	shutdownTimeout := config.ShutdownTimeout
+	if shutdownTimeout <= 0 {
+		shutdownTimeout = SHUTDOWN_TIMEOUT
+	}
+	slog.Info("shutting down", "timeout", shutdownTimeout)
+	shutdownCtx, cancelShutdown := context.WithTimeout(
+		context.Background(),
+		shutdownTimeout,
+	)
+	defer cancelShutdown()
+	// sockets are hijacked, so the server stops accepting them and finishes
+	// in-flight requests, leaving open sockets to the chat service
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("error shutting down server", "error", err.Error())
+	}
+	if err := chatService.Shutdown(shutdownCtx); err != nil {
+		slog.Error("error shutting down chat service", "error", err.Error())
+	}
+	if err := <-serverErrors; !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("server error", "error", err.Error())
 	}
+	slog.Info("server stopped")
 }
@@ -0,0 +1,119 @@
+package postgres
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const RECONNECT_WAIT = 2 * time.Second
+
+// fans payloads out to every server listening on the same channel using
+// LISTEN/NOTIFY; payloads are limited to 8000 bytes by postgres
+type Broadcaster struct {
+	pool    *pgxpool.Pool
+	channel string
+}
+
+func NewBroadcaster(pool *pgxpool.Pool, channel string) *Broadcaster {
+	return &Broadcaster{
+		pool:    pool,
+		channel: channel,
+	}
+}
+
+func (b *Broadcaster) Publish(ctx context.Context, payload []byte) error {
+	_, err := b.pool.Exec(
+		ctx,
+		"SELECT pg_notify($1, $2)",
+		b.channel,
+		string(payload),
+	)
+	return err
+}
+
+// the returned channel is closed once ctx is done; notifications sent while
+// the listening connection is re-established are lost, so an empty payload
+// is sent once listening again to tell the subscriber about the gap
+func (b *Broadcaster) Subscribe(ctx context.Context) (<-chan []byte, error) {
+	conn, err := b.listen(ctx)
+	if err != nil {
+		return nil, err
+	}
+	payloads := make(chan []byte)
+	go func() {
+		defer func() {
+			close(payloads)
+			if conn != nil {
+				conn.Close(context.Background())
+			}
+		}()
+		for {
+			notification, err := conn.WaitForNotification(ctx)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				slog.Error("error waiting for notification", "error", err.Error())
+				conn.Close(context.Background())
+				lostAt := time.Now()
+				conn = b.relisten(ctx)
+				if conn == nil {
+					return
+				}
+				slog.Warn(
+					"notifications may have been lost while relistening",
+					"channel", b.channel,
+					"gap", time.Since(lostAt).String(),
+				)
+				select {
+				case <-ctx.Done():
+					return
+				case payloads <- []byte{}:
+				}
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case payloads <- []byte(notification.Payload):
+			}
+		}
+	}()
+	return payloads, nil
+}
+
+// the connection is hijacked from the pool so that it is never handed out
+// again while still listening
+func (b *Broadcaster) listen(ctx context.Context) (*pgx.Conn, error) {
+	poolConn, err := b.pool.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	conn := poolConn.Hijack()
+	sql := "LISTEN " + pgx.Identifier{b.channel}.Sanitize()
+	if _, err := conn.Exec(ctx, sql); err != nil {
+		conn.Close(context.Background())
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (b *Broadcaster) relisten(ctx context.Context) *pgx.Conn {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(RECONNECT_WAIT):
+		}
+		conn, err := b.listen(ctx)
+		if err == nil {
+			slog.Info("relistening", "channel", b.channel)
+			return conn
+		}
+		slog.Error("error relistening", "error", err.Error())
+	}
+}
@@ -0,0 +1,172 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+
+	"github.com/gofrs/uuid/v5"
+)
+
+// backbone shared by every server instance so that rooms on one instance see
+// the events handled by rooms on the others; subscriptions send an empty
+// payload after any gap in which payloads may have been lost
+type Broadcaster interface {
+	Publish(ctx context.Context, payload []byte) error
+	Subscribe(ctx context.Context) (<-chan []byte, error)
+}
+
+const (
+	BROADCAST_MESSAGE_SAVED    = "message.saved"
+	BROADCAST_MESSAGE_EDITED   = "message.edited"
+	BROADCAST_MESSAGE_DELETED  = "message.deleted"
+	BROADCAST_REACTION_ADDED   = "reaction.added"
+	BROADCAST_REACTION_REMOVED = "reaction.removed"
+	BROADCAST_ROOM_CREATED     = "room.created"
+	BROADCAST_USER_JOINED      = "user.joined"
+	BROADCAST_USER_LEFT        = "user.left"
+	BROADCAST_USER_KICKED      = "user.kicked"
+	BROADCAST_ROOM_RENAMED     = "room.renamed"
+	BROADCAST_ROOM_DELETED     = "room.deleted"
+	BROADCAST_TYPING           = "typing"
+	BROADCAST_PRESENCE         = "presence"
+	BROADCAST_READ             = "read"
+	BROADCAST_LOGGED_OUT       = "logged.out"
+)
+
+// only identifiers are sent, receivers load anything else from the
+// repository, keeping payloads well under the NOTIFY size limit
+type broadcast struct {
+	Origin    uuid.UUID `json:"origin"`
+	Kind      string    `json:"kind"`
+	RoomId    uuid.UUID `json:"roomId"`
+	UserId    uuid.UUID `json:"userId,omitempty"`
+	MessageId uuid.UUID `json:"messageId,omitempty"`
+	Emoji     string    `json:"emoji,omitempty"`
+	Name      string    `json:"name,omitempty"`
+	Typing    bool      `json:"typing,omitempty"`
+	Presence  string    `json:"presence,omitempty"`
+	SessionId uuid.UUID `json:"sessionId,omitempty"`
+}
+
+func (service *Service) publish(broadcast broadcast) {
+	broadcast.Origin = service.instanceId
+	payload, err := json.Marshal(broadcast)
+	if err != nil {
+		slog.Error("error marshalling broadcast", "broadcast", broadcast)
+		return
+	}
+	if err := service.broadcaster.Publish(
+		context.Background(),
+		payload,
+	); err != nil {
+		slog.Error(
+			"error publishing broadcast",
+			"error", err.Error(),
+			"broadcast", broadcast,
+		)
+	}
+}
+
+func (service *Service) receiveBroadcasts(payloads <-chan []byte) {
+	for {
+		payload, ok := <-payloads
+		if !ok {
+			return
+		}
+		if len(payload) == 0 {
+			slog.Warn("resyncing rooms after lost broadcasts")
+			for _, room := range service.allRooms() {
+				room.push(roomResyncEvent{})
+			}
+			continue
+		}
+		var broadcast broadcast
+		if err := json.Unmarshal(payload, &broadcast); err != nil {
+			slog.Error("error unmarshalling broadcast", "payload", payload)
+			continue
+		}
+		if broadcast.Origin == service.instanceId {
+			continue
+		}
+		service.broadcastHandler(broadcast)
+	}
+}
+
+func (service *Service) broadcastHandler(broadcast broadcast) {
+	switch broadcast.Kind {
+	case BROADCAST_MESSAGE_SAVED:
+		service.roomIngress(broadcast.RoomId, remoteMessageEvent{
+			messageId: broadcast.MessageId,
+			frameType: FRAME_MESSAGE_NEW,
+		})
+	case BROADCAST_MESSAGE_EDITED:
+		service.roomIngress(broadcast.RoomId, remoteMessageEvent{
+			messageId: broadcast.MessageId,
+			frameType: FRAME_MESSAGE_EDITED,
+		})
+	case BROADCAST_MESSAGE_DELETED:
+		service.roomIngress(broadcast.RoomId, remoteMessageEvent{
+			messageId: broadcast.MessageId,
+			frameType: FRAME_MESSAGE_DELETED,
+		})
+	case BROADCAST_REACTION_ADDED, BROADCAST_REACTION_REMOVED:
+		service.roomIngress(broadcast.RoomId, remoteReactionEvent{
+			userId:    broadcast.UserId,
+			messageId: broadcast.MessageId,
+			emoji:     broadcast.Emoji,
+			added:     broadcast.Kind == BROADCAST_REACTION_ADDED,
+		})
+	case BROADCAST_ROOM_CREATED:
+		room, err := newRoom(service, broadcast.RoomId)
+		if err != nil {
+			slog.Error("error initing room", "roomId", broadcast.RoomId)
+			return
+		}
+		service.push(roomCreatedEvent{room: room})
+	case BROADCAST_USER_JOINED:
+		service.roomIngress(
+			broadcast.RoomId,
+			userJoinedRoomEvent{userId: broadcast.UserId},
+		)
+	case BROADCAST_USER_LEFT, BROADCAST_USER_KICKED:
+		service.roomIngress(broadcast.RoomId, userLeftRoomEvent{
+			userId: broadcast.UserId,
+			kicked: broadcast.Kind == BROADCAST_USER_KICKED,
+		})
+	case BROADCAST_ROOM_RENAMED:
+		service.roomIngress(
+			broadcast.RoomId,
+			roomRenamedEvent{name: broadcast.Name},
+		)
+	case BROADCAST_ROOM_DELETED:
+		service.push(roomDeletedEvent{roomId: broadcast.RoomId})
+	case BROADCAST_PRESENCE:
+		service.push(presenceEvent{
+			userId:   broadcast.UserId,
+			username: broadcast.Name,
+			presence: broadcast.Presence,
+			remote:   true,
+		})
+	case BROADCAST_READ:
+		service.roomIngress(broadcast.RoomId, readReceiptEvent{
+			userId:    broadcast.UserId,
+			messageId: broadcast.MessageId,
+			remote:    true,
+		})
+	case BROADCAST_LOGGED_OUT:
+		service.push(userLoggedOutEvent{
+			userId:    broadcast.UserId,
+			sessionId: broadcast.SessionId,
+		})
+	case BROADCAST_TYPING:
+		service.roomIngress(broadcast.RoomId, typingEvent{
+			userId:   broadcast.UserId,
+			username: broadcast.Name,
+			typing:   broadcast.Typing,
+			remote:   true,
+		})
+	default:
+		slog.Error("invalid broadcast", "broadcast", broadcast)
+	}
+}
@@ -2,12 +2,64 @@ package chat
 
 import "time"
 
+// time allowed to write a frame to a socket
 const WRITE_WAIT = 10 * time.Second
 
+// time allowed between reads before a socket is considered dead, pongs count
 const PONG_WAIT = 60 * time.Second
 
+// must be less than the pong wait so that pongs can arrive in time
 const PING_PERIOD = PONG_WAIT * 9 / 10
 
 const MAX_MESSAGE_SIZE = 10000
 
 const BUFFER_SIZE = 4096
+
+const BROADCAST_CHANNEL = "gossip_chat"
+
+const MAX_CLIENT_ID_LENGTH = 255
+
+const REPLAY_LIMIT = 500
+
+const MAX_EMOJI_LENGTH = 64
+
+// typing indicators are cleared if a client stops refreshing them
+const TYPING_TIMEOUT = 6 * time.Second
+
+// must stay well under repository.PRESENCE_STALE_AFTER
+const PRESENCE_HEARTBEAT = time.Minute
+
+// outbound frames queued per connection before the overflow policy applies
+const SEND_QUEUE_SIZE = 256
+
+// what happens to a frame pushed to a connection whose queue is full
+const (
+	// the oldest queued frame is dropped to make room
+	OVERFLOW_DROP_OLDEST = "drop-oldest"
+	// a queued typing, presence, read or activity frame superseded by the
+	// new one is dropped, failing that the connection is disconnected
+	OVERFLOW_COALESCE = "coalesce"
+	// the connection is disconnected, its client reconnects and replays
+	OVERFLOW_DISCONNECT = "disconnect"
+)
+
+const DEFAULT_OVERFLOW_POLICY = OVERFLOW_DISCONNECT
+
+// sent with the close frame when shutting down
+const SHUTDOWN_REASON = "server restarting, reconnect"
+
+// frames a user may send across all of their connections, one more every
+// interval up to the burst
+const USER_RATE_INTERVAL = 100 * time.Millisecond
+
+const USER_RATE_BURST = 50
+
+// messages sent into a room by all of its members
+const ROOM_RATE_INTERVAL = 20 * time.Millisecond
+
+const ROOM_RATE_BURST = 100
+
+// frames refused in quick succession before a user is muted
+const MUTE_AFTER = 20
+
+const MUTE_DURATION = time.Minute
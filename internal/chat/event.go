@@ -6,30 +6,108 @@ import (
 
 type event interface{}
 
+type frameReceivedEvent struct {
+	frame *frame
+}
+
 type messageEvent struct {
-	payload *message
-	roomId  uuid.UUID
-	userId  uuid.UUID
+	payload  *message
+	roomId   uuid.UUID
+	userId   uuid.UUID
+	parentId *uuid.UUID
+	sender   *user
+	frameId  string
 }
 
 func newMessageEvent(
-	userId uuid.UUID,
-	username string,
-	message *message,
+	sender *user,
+	frameId string,
+	payload messageSendPayload,
 ) (messageEvent, error) {
-	roomId, err := uuid.FromString(message.RoomId)
+	roomId, err := uuid.FromString(payload.RoomId)
 	if err != nil {
 		return messageEvent{}, err
 	}
-	message.UserId = userId.String()
-	message.Username = username
+	var parentId *uuid.UUID
+	if payload.ParentId != "" {
+		id, err := uuid.FromString(payload.ParentId)
+		if err != nil {
+			return messageEvent{}, err
+		}
+		parentId = &id
+	}
 	return messageEvent{
-		payload: message,
-		roomId:  roomId,
-		userId:  userId,
+		payload: &message{
+			ClientId: payload.ClientId,
+			RoomId:   roomId.String(),
+			UserId:   sender.userId.String(),
+			Username: sender.username,
+			Body:     payload.Body,
+		},
+		roomId:   roomId,
+		userId:   sender.userId,
+		parentId: parentId,
+		sender:   sender,
+		frameId:  frameId,
 	}, nil
 }
 
+type remoteMessageEvent struct {
+	messageId uuid.UUID
+	frameType string
+}
+
+type messageEditEvent struct {
+	userId    uuid.UUID
+	messageId uuid.UUID
+	body      string
+	done      chan error
+}
+
+type messageDeleteEvent struct {
+	userId    uuid.UUID
+	messageId uuid.UUID
+	done      chan error
+}
+
+type reactionEvent struct {
+	userId    uuid.UUID
+	messageId uuid.UUID
+	emoji     string
+	added     bool
+	sender    *user
+	frameId   string
+}
+
+type remoteReactionEvent struct {
+	userId    uuid.UUID
+	messageId uuid.UUID
+	emoji     string
+	added     bool
+}
+
+type typingEvent struct {
+	userId   uuid.UUID
+	username string
+	typing   bool
+	remote   bool
+	sender   *user
+	frameId  string
+}
+
+type typingExpiredEvent struct {
+	userId uuid.UUID
+	typist *typist
+}
+
+type readReceiptEvent struct {
+	userId    uuid.UUID
+	messageId uuid.UUID
+	remote    bool
+	sender    *user
+	frameId   string
+}
+
 type roomCreatedEvent struct {
 	room *room
 }
@@ -39,13 +117,52 @@ type userConnectedEvent struct {
 }
 
 type userDisconnectedEvent struct {
-	userId uuid.UUID
+	user *user
+}
+
+type userLoggedOutEvent struct {
+	userId    uuid.UUID
+	sessionId uuid.UUID
 }
 
+type presenceEvent struct {
+	userId   uuid.UUID
+	username string
+	presence string
+	remote   bool
+}
+
+type presenceChangedEvent struct {
+	user     *user
+	presence string
+}
+
+type presenceHeartbeatEvent struct{}
+
 type userJoinedRoomEvent struct {
 	userId uuid.UUID
 }
 
 type userLeftRoomEvent struct {
 	userId uuid.UUID
+	kicked bool
+}
+
+type roomRenamedEvent struct {
+	name string
+}
+
+type roomDeletedEvent struct {
+	roomId uuid.UUID
+}
+
+type roomClosedEvent struct{}
+
+type roomDrainedEvent struct{}
+
+// broadcasts may have been lost, so the room catches up from the database
+type roomResyncEvent struct{}
+
+type shutdownEvent struct {
+	stopped chan []*user
 }
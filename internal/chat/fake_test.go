@@ -0,0 +1,422 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"gossip/internal/repository"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/gorilla/websocket"
+	"github.com/jackc/pgx/v5"
+)
+
+func TestMain(m *testing.M) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// in-memory stand-in for the postgres repository
+type fakeRepository struct {
+	mu       sync.Mutex
+	rooms    []uuid.UUID
+	members  map[uuid.UUID]map[uuid.UUID]bool
+	messages map[uuid.UUID]repository.MessageFindOneResult
+	// presence per instance, and across instances, of each user; nothing
+	// goes stale
+	instancePresences map[uuid.UUID]map[uuid.UUID]string
+	presences         map[uuid.UUID]string
+}
+
+func newFakeRepository() *fakeRepository {
+	return &fakeRepository{
+		members:           make(map[uuid.UUID]map[uuid.UUID]bool),
+		messages:          make(map[uuid.UUID]repository.MessageFindOneResult),
+		instancePresences: make(map[uuid.UUID]map[uuid.UUID]string),
+		presences:         make(map[uuid.UUID]string),
+	}
+}
+
+func (r *fakeRepository) presence(userId uuid.UUID) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if presence, ok := r.presences[userId]; ok {
+		return presence
+	}
+	return repository.PRESENCE_OFFLINE
+}
+
+func (r *fakeRepository) addRoom(userIds ...uuid.UUID) uuid.UUID {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	roomId := uuid.Must(uuid.NewV4())
+	r.rooms = append(r.rooms, roomId)
+	r.members[roomId] = make(map[uuid.UUID]bool)
+	for _, userId := range userIds {
+		r.members[roomId][userId] = true
+	}
+	return roomId
+}
+
+func (r *fakeRepository) messageIds() []uuid.UUID {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	messageIds := []uuid.UUID{}
+	for messageId := range r.messages {
+		messageIds = append(messageIds, messageId)
+	}
+	return messageIds
+}
+
+func (r *fakeRepository) RoomFindMany(
+	ctx context.Context,
+) ([]repository.RoomFindManyResult, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	results := []repository.RoomFindManyResult{}
+	for _, roomId := range r.rooms {
+		results = append(results, repository.RoomFindManyResult{RoomId: roomId})
+	}
+	return results, nil
+}
+
+func (r *fakeRepository) UsersFindManyByRoomId(
+	ctx context.Context,
+	dto repository.UsersFindManyByRoomIdParams,
+) ([]repository.UsersFindManyByRoomIdResult, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	results := []repository.UsersFindManyByRoomIdResult{}
+	for userId := range r.members[dto.RoomId] {
+		results = append(results, repository.UsersFindManyByRoomIdResult{
+			UserId: userId,
+		})
+	}
+	return results, nil
+}
+
+func (r *fakeRepository) UserCheckRoomMembership(
+	ctx context.Context,
+	dto repository.UserCheckRoomMembershipParams,
+) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.members[dto.RoomId][dto.UserId], nil
+}
+
+func (r *fakeRepository) UserPresenceUpdate(
+	ctx context.Context,
+	dto repository.UserPresenceUpdateParams,
+) (repository.UserPresenceUpdateResult, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	instances, ok := r.instancePresences[dto.UserId]
+	if !ok {
+		instances = make(map[uuid.UUID]string)
+		r.instancePresences[dto.UserId] = instances
+	}
+	if dto.Presence == repository.PRESENCE_OFFLINE {
+		delete(instances, dto.InstanceId)
+	} else {
+		instances[dto.InstanceId] = dto.Presence
+	}
+	after := repository.PRESENCE_OFFLINE
+	for _, presence := range instances {
+		if presence == repository.PRESENCE_ONLINE {
+			after = presence
+			break
+		}
+		after = presence
+	}
+	before, ok := r.presences[dto.UserId]
+	if !ok {
+		before = repository.PRESENCE_OFFLINE
+	}
+	r.presences[dto.UserId] = after
+	return repository.UserPresenceUpdateResult{
+		Presence: after,
+		Changed:  after != before,
+	}, nil
+}
+
+func (r *fakeRepository) UsersLastSeenTouch(
+	ctx context.Context,
+	dto repository.UsersLastSeenTouchParams,
+) error {
+	return nil
+}
+
+func (r *fakeRepository) RoomReadUpdate(
+	ctx context.Context,
+	dto repository.RoomReadUpdateParams,
+) (bool, error) {
+	return true, nil
+}
+
+func (r *fakeRepository) MessageSave(
+	ctx context.Context,
+	dto repository.MessageSaveParams,
+) (repository.MessageSaveResult, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	messageId := uuid.Must(uuid.NewV4())
+	timestamp := time.Now()
+	r.messages[messageId] = repository.MessageFindOneResult{
+		MessageId: messageId,
+		UserId:    dto.UserId,
+		RoomId:    dto.RoomId,
+		Body:      dto.Body,
+		Timestamp: timestamp,
+	}
+	return repository.MessageSaveResult{
+		MessageId: messageId,
+		Timestamp: timestamp,
+	}, nil
+}
+
+func (r *fakeRepository) MessageFindOne(
+	ctx context.Context,
+	dto repository.MessageFindOneParams,
+) (repository.MessageFindOneResult, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	result, ok := r.messages[dto.MessageId]
+	if !ok {
+		return repository.MessageFindOneResult{}, pgx.ErrNoRows
+	}
+	return result, nil
+}
+
+// the room's messages in (timestamp, id) order
+func (r *fakeRepository) roomMessages(
+	roomId uuid.UUID,
+) []repository.MessagesFindManyByRoomIdResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	results := []repository.MessagesFindManyByRoomIdResult{}
+	for _, message := range r.messages {
+		if message.RoomId != roomId {
+			continue
+		}
+		results = append(
+			results,
+			repository.MessagesFindManyByRoomIdResult(message),
+		)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if !results[i].Timestamp.Equal(results[j].Timestamp) {
+			return results[i].Timestamp.Before(results[j].Timestamp)
+		}
+		return results[i].MessageId.String() < results[j].MessageId.String()
+	})
+	return results
+}
+
+func (r *fakeRepository) MessagesFindManyByRoomId(
+	ctx context.Context,
+	dto repository.MessagesFindManyByRoomIdParams,
+) ([]repository.MessagesFindManyByRoomIdResult, error) {
+	results := r.roomMessages(dto.RoomId)
+	if dto.Before != nil {
+		for i, result := range results {
+			if result.MessageId == *dto.Before {
+				results = results[:i]
+				break
+			}
+		}
+	}
+	return results[max(len(results)-dto.Limit, 0):], nil
+}
+
+func (r *fakeRepository) MessagesFindManyByRoomIdAfter(
+	ctx context.Context,
+	dto repository.MessagesFindManyByRoomIdAfterParams,
+) ([]repository.MessagesFindManyByRoomIdResult, error) {
+	results := r.roomMessages(dto.RoomId)
+	if dto.MessageId != nil {
+		for i, result := range results {
+			if result.MessageId == *dto.MessageId {
+				results = results[i+1:]
+				break
+			}
+		}
+	}
+	return results[:min(dto.Limit, len(results))], nil
+}
+
+func (r *fakeRepository) MessageUpdate(
+	ctx context.Context,
+	dto repository.MessageUpdateParams,
+) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	result, ok := r.messages[dto.MessageId]
+	if !ok || result.UserId != dto.UserId {
+		return false, nil
+	}
+	result.Body = dto.Body
+	r.messages[dto.MessageId] = result
+	return true, nil
+}
+
+func (r *fakeRepository) MessageDelete(
+	ctx context.Context,
+	dto repository.MessageDeleteParams,
+) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	result, ok := r.messages[dto.MessageId]
+	if !ok || result.UserId != dto.UserId {
+		return false, nil
+	}
+	now := time.Now()
+	result.DeletedAt = &now
+	r.messages[dto.MessageId] = result
+	return true, nil
+}
+
+func (r *fakeRepository) ReactionAdd(
+	ctx context.Context,
+	dto repository.ReactionAddParams,
+) (bool, error) {
+	return true, nil
+}
+
+func (r *fakeRepository) ReactionRemove(
+	ctx context.Context,
+	dto repository.ReactionRemoveParams,
+) (bool, error) {
+	return true, nil
+}
+
+// drops everything it is given, there being a single instance in tests
+type fakeBroadcaster struct{}
+
+func (b fakeBroadcaster) Publish(ctx context.Context, payload []byte) error {
+	return nil
+}
+
+func (b fakeBroadcaster) Subscribe(ctx context.Context) (<-chan []byte, error) {
+	payloads := make(chan []byte)
+	go func() {
+		<-ctx.Done()
+		close(payloads)
+	}()
+	return payloads, nil
+}
+
+// delivers every payload to every subscriber, standing in for postgres when
+// several instances share it; publishing never blocks, like NOTIFY
+type fakeBus struct {
+	mu          sync.Mutex
+	subscribers map[chan []byte]bool
+}
+
+func newFakeBus() *fakeBus {
+	return &fakeBus{subscribers: make(map[chan []byte]bool)}
+}
+
+func (b *fakeBus) Publish(ctx context.Context, payload []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for subscriber := range b.subscribers {
+		select {
+		case subscriber <- payload:
+		default:
+			return errors.New("subscriber is full")
+		}
+	}
+	return nil
+}
+
+func (b *fakeBus) Subscribe(ctx context.Context) (<-chan []byte, error) {
+	payloads := make(chan []byte, 1024)
+	b.mu.Lock()
+	b.subscribers[payloads] = true
+	b.mu.Unlock()
+	go func() {
+		<-ctx.Done()
+		b.mu.Lock()
+		delete(b.subscribers, payloads)
+		b.mu.Unlock()
+		close(payloads)
+	}()
+	return payloads, nil
+}
+
+// serves the service over a test server, connecting as the user, session
+// and client in the query parameters
+func newTestServer(t *testing.T, service *Service) *httptest.Server {
+	server := httptest.NewServer(testHandler(t, service))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func testHandler(t *testing.T, service *Service) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		userId, err := uuid.FromString(query.Get("userId"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sessionId, _ := uuid.FromString(query.Get("sessionId"))
+		err = service.UserConnect(w, r, UserConnectParams{
+			UserId:    userId,
+			Username:  "user",
+			SessionId: sessionId,
+			ClientId:  query.Get("clientId"),
+		})
+		if errors.Is(err, ShuttingDownError) {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			t.Error("failed to connect", err)
+		}
+	})
+}
+
+func dial(server *httptest.Server, userId uuid.UUID) (*websocket.Conn, error) {
+	return dialClient(server, userId, uuid.Nil, "")
+}
+
+func dialClient(
+	server *httptest.Server,
+	userId uuid.UUID,
+	sessionId uuid.UUID,
+	clientId string,
+) (*websocket.Conn, error) {
+	query := url.Values{}
+	query.Set("userId", userId.String())
+	query.Set("sessionId", sessionId.String())
+	query.Set("clientId", clientId)
+	conn, _, err := websocket.DefaultDialer.Dial(
+		"ws"+strings.TrimPrefix(server.URL, "http")+"?"+query.Encode(),
+		nil,
+	)
+	return conn, err
+}
+
+func writeFrame(conn *websocket.Conn, frameType string, id string, payload any) error {
+	frame, err := newFrame(frameType, id, payload)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(frame)
+	if err != nil {
+		return err
+	}
+	return conn.WriteMessage(websocket.TextMessage, data)
+}
@@ -0,0 +1,223 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"time"
+)
+
+const PROTOCOL_VERSION = 1
+
+// frame types
+const (
+	FRAME_MESSAGE_SEND     = "message.send"
+	FRAME_MESSAGE_NEW      = "message.new"
+	FRAME_MESSAGE_EDIT     = "message.edit"
+	FRAME_MESSAGE_EDITED   = "message.edited"
+	FRAME_MESSAGE_DELETE   = "message.delete"
+	FRAME_MESSAGE_DELETED  = "message.deleted"
+	FRAME_REACTION_ADD     = "reaction.add"
+	FRAME_REACTION_ADDED   = "reaction.added"
+	FRAME_REACTION_REMOVE  = "reaction.remove"
+	FRAME_REACTION_REMOVED = "reaction.removed"
+	FRAME_TYPING           = "typing"
+	FRAME_PRESENCE         = "presence"
+	FRAME_READ             = "read"
+	// only ever sent: clients join and leave through /api/rooms/join and
+	// /api/rooms/leave, which check visibility, invites, join requests and
+	// roles that the socket has no business duplicating
+	FRAME_ROOM_JOINED      = "room.joined"
+	FRAME_ROOM_LEFT        = "room.left"
+	FRAME_ROOM_KICKED      = "room.kicked"
+	FRAME_ROOM_RENAMED     = "room.renamed"
+	FRAME_ROOM_DELETED     = "room.deleted"
+	FRAME_ROOM_SUBSCRIBE   = "room.subscribe"
+	FRAME_ROOM_UNSUBSCRIBE = "room.unsubscribe"
+	FRAME_ROOM_ACTIVITY    = "room.activity"
+	FRAME_REPLAY_DONE      = "replay.done"
+	FRAME_ERROR            = "error"
+	FRAME_ACK              = "ack"
+)
+
+// error codes
+const (
+	ERROR_INVALID_FRAME       = "invalid_frame"
+	ERROR_UNSUPPORTED_VERSION = "unsupported_version"
+	ERROR_UNKNOWN_TYPE        = "unknown_type"
+	ERROR_ROOM_NOT_FOUND      = "room_not_found"
+	ERROR_SAVE_FAILED         = "save_failed"
+	ERROR_MESSAGE_NOT_FOUND   = "message_not_found"
+	ERROR_FORBIDDEN           = "forbidden"
+	ERROR_NOT_ROOM_MEMBER     = "not_room_member"
+	ERROR_SHUTTING_DOWN       = "shutting_down"
+	ERROR_RATE_LIMITED        = "rate_limited"
+	ERROR_MUTED               = "muted"
+	ERROR_INTERNAL            = "internal"
+)
+
+// close codes in the range left to applications, sent along with the
+// standard ones
+const (
+	// no pong arrived within the pong wait
+	CLOSE_IDLE = 4000
+	// the session the socket was opened with ended
+	CLOSE_LOGGED_OUT = 4001
+	// the user was kicked from the room the socket was subscribed to
+	CLOSE_KICKED = 4002
+	// the same client connected again
+	CLOSE_REPLACED = 4003
+)
+
+// envelope for everything sent over the socket in either direction; id is
+// chosen by whoever originates a request and echoed back in its ack or error
+type frame struct {
+	Version int             `json:"v"`
+	Type    string          `json:"type"`
+	Id      string          `json:"id,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+func newFrame(frameType string, id string, payload any) (*frame, error) {
+	frame := &frame{
+		Version: PROTOCOL_VERSION,
+		Type:    frameType,
+		Id:      id,
+	}
+	if payload == nil {
+		return frame, nil
+	}
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	frame.Payload = raw
+	return frame, nil
+}
+
+// frames that only carry the latest state of something are identified by
+// their type, room and user, a newer frame superseding an older one
+func coalesceKey(frame *frame) (string, bool) {
+	switch frame.Type {
+	case FRAME_TYPING, FRAME_PRESENCE, FRAME_READ, FRAME_ROOM_ACTIVITY:
+	default:
+		return "", false
+	}
+	var payload struct {
+		RoomId string `json:"roomId"`
+		UserId string `json:"userId"`
+	}
+	if err := json.Unmarshal(frame.Payload, &payload); err != nil {
+		return "", false
+	}
+	return frame.Type + ":" + payload.RoomId + ":" + payload.UserId, true
+}
+
+func mustNewFrame(frameType string, id string, payload any) *frame {
+	frame, err := newFrame(frameType, id, payload)
+	if err != nil {
+		slog.Error("error creating frame", "type", frameType, "error", err)
+		frame, _ = newFrame(FRAME_ERROR, id, errorPayload{
+			Code:    ERROR_INTERNAL,
+			Message: "error encoding frame",
+		})
+	}
+	return frame
+}
+
+// maps errors returned by the service to the code sent to clients
+func errorCode(err error) string {
+	switch {
+	case errors.Is(err, RoomNotFoundError):
+		return ERROR_ROOM_NOT_FOUND
+	case errors.Is(err, MessageNotFoundError):
+		return ERROR_MESSAGE_NOT_FOUND
+	case errors.Is(err, NotMessageAuthorError):
+		return ERROR_FORBIDDEN
+	case errors.Is(err, NotRoomMemberError):
+		return ERROR_NOT_ROOM_MEMBER
+	case errors.Is(err, EmptyMessageError):
+		return ERROR_INVALID_FRAME
+	case errors.Is(err, ShuttingDownError):
+		return ERROR_SHUTTING_DOWN
+	default:
+		return ERROR_INTERNAL
+	}
+}
+
+func decodePayload[T any](frame *frame) (T, error) {
+	var payload T
+	err := json.Unmarshal(frame.Payload, &payload)
+	return payload, err
+}
+
+// payloads
+
+type messageSendPayload struct {
+	ClientId string `json:"clientId"`
+	RoomId   string `json:"roomId"`
+	ParentId string `json:"parentId,omitempty"`
+	Body     string `json:"body"`
+}
+
+type messageEditPayload struct {
+	MessageId string `json:"messageId"`
+	Body      string `json:"body"`
+}
+
+type messageDeletePayload struct {
+	MessageId string `json:"messageId"`
+}
+
+type reactionPayload struct {
+	RoomId    string `json:"roomId"`
+	MessageId string `json:"messageId"`
+	UserId    string `json:"userId,omitempty"`
+	Emoji     string `json:"emoji"`
+}
+
+type typingPayload struct {
+	RoomId   string `json:"roomId"`
+	UserId   string `json:"userId,omitempty"`
+	Username string `json:"username,omitempty"`
+	Typing   bool   `json:"typing"`
+}
+
+type readReceiptPayload struct {
+	RoomId    string `json:"roomId"`
+	MessageId string `json:"messageId"`
+	UserId    string `json:"userId,omitempty"`
+}
+
+type presencePayload struct {
+	UserId   string `json:"userId,omitempty"`
+	Username string `json:"username,omitempty"`
+	Presence string `json:"presence"`
+}
+
+type subscriptionPayload struct {
+	RoomId string `json:"roomId"`
+}
+
+type membershipPayload struct {
+	RoomId string `json:"roomId"`
+	UserId string `json:"userId"`
+}
+
+type ackPayload struct {
+	ClientId  string    `json:"clientId,omitempty"`
+	MessageId string    `json:"messageId"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type roomPayload struct {
+	RoomId string `json:"roomId"`
+	Name   string `json:"name,omitempty"`
+}
+
+type errorPayload struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// milliseconds to wait before sending again when throttled or muted
+	RetryAfter int64 `json:"retryAfter,omitempty"`
+}
@@ -1,11 +1,71 @@
 package chat
 
-import "time"
+import (
+	"gossip/internal/repository"
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+)
 
 type message struct {
-	RoomId    string    `json:"roomId"`
-	UserId    string    `json:"userId"`
-	Username  string    `json:"username"`
-	Body      string    `json:"body"`
-	Timestamp time.Time `json:"timestamp"`
+	MessageId      string                `json:"messageId"`
+	ClientId       string                `json:"clientId,omitempty"`
+	RoomId         string                `json:"roomId"`
+	UserId         string                `json:"userId"`
+	Username       string                `json:"username"`
+	Body           string                `json:"body"`
+	Timestamp      time.Time             `json:"timestamp"`
+	EditedAt       *time.Time            `json:"editedAt,omitempty"`
+	DeletedAt      *time.Time            `json:"deletedAt,omitempty"`
+	ParentId       *string               `json:"parentId,omitempty"`
+	ParentUsername *string               `json:"parentUsername,omitempty"`
+	ParentBody     *string               `json:"parentBody,omitempty"`
+	ReplyCount     int                   `json:"replyCount"`
+	Reactions      []repository.Reaction `json:"reactions"`
+}
+
+func newMessageFromFindOne(result repository.MessageFindOneResult) *message {
+	return &message{
+		MessageId:      result.MessageId.String(),
+		RoomId:         result.RoomId.String(),
+		UserId:         result.UserId.String(),
+		Username:       result.Username,
+		Body:           result.Body,
+		Timestamp:      result.Timestamp,
+		EditedAt:       result.EditedAt,
+		DeletedAt:      result.DeletedAt,
+		ParentId:       optionalString(result.ParentId),
+		ParentUsername: result.ParentUsername,
+		ParentBody:     result.ParentBody,
+		ReplyCount:     result.ReplyCount,
+		Reactions:      result.Reactions,
+	}
+}
+
+func newMessageFromFindMany(
+	result repository.MessagesFindManyByRoomIdResult,
+) *message {
+	return &message{
+		MessageId:      result.MessageId.String(),
+		RoomId:         result.RoomId.String(),
+		UserId:         result.UserId.String(),
+		Username:       result.Username,
+		Body:           result.Body,
+		Timestamp:      result.Timestamp,
+		EditedAt:       result.EditedAt,
+		DeletedAt:      result.DeletedAt,
+		ParentId:       optionalString(result.ParentId),
+		ParentUsername: result.ParentUsername,
+		ParentBody:     result.ParentBody,
+		ReplyCount:     result.ReplyCount,
+		Reactions:      result.Reactions,
+	}
+}
+
+func optionalString(id *uuid.UUID) *string {
+	if id == nil {
+		return nil
+	}
+	value := id.String()
+	return &value
 }
@@ -0,0 +1,12 @@
+package chat
+
+import "expvar"
+
+// published on /debug/vars of the internal debug listener
+var (
+	rejectedSends      = expvar.NewInt("chat_rejected_sends")
+	droppedFrames      = expvar.NewInt("chat_dropped_frames")
+	coalescedFrames    = expvar.NewInt("chat_coalesced_frames")
+	evictedConnections = expvar.NewInt("chat_evicted_connections")
+	throttledFrames    = expvar.NewInt("chat_throttled_frames")
+)
@@ -0,0 +1,99 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"gossip/internal/repository"
+	"log/slog"
+	"strings"
+
+	"github.com/gofrs/uuid/v5"
+)
+
+var invalidCursorError = errors.New("invalid cursor")
+
+// last message a client has seen in a room; a nil message ID means the
+// client has seen nothing in the room yet
+type Cursor struct {
+	RoomId    uuid.UUID
+	MessageId *uuid.UUID
+}
+
+// parses "<roomId>" or "<roomId>:<messageId>"
+func ParseCursor(value string) (Cursor, error) {
+	roomIdValue, messageIdValue, hasMessageId := strings.Cut(value, ":")
+	roomId, err := uuid.FromString(roomIdValue)
+	if err != nil {
+		return Cursor{}, invalidCursorError
+	}
+	if !hasMessageId {
+		return Cursor{RoomId: roomId}, nil
+	}
+	messageId, err := uuid.FromString(messageIdValue)
+	if err != nil {
+		return Cursor{}, invalidCursorError
+	}
+	return Cursor{RoomId: roomId, MessageId: &messageId}, nil
+}
+
+type replayDonePayload struct {
+	RoomId    string `json:"roomId"`
+	Truncated bool   `json:"truncated"`
+}
+
+// writes everything persisted after each cursor straight to the socket, so
+// it must only be called from writePump before live frames are written;
+// clients drop live frames for messages they already received here
+func (user *user) replay() error {
+	for _, cursor := range user.cursors {
+		isMember, err := user.service.repository.UserCheckRoomMembership(
+			context.Background(),
+			repository.UserCheckRoomMembershipParams{
+				UserId: user.userId,
+				RoomId: cursor.RoomId,
+			},
+		)
+		if err != nil || !isMember {
+			slog.Error(
+				"not replaying room",
+				"userId", user.userId,
+				"roomId", cursor.RoomId,
+			)
+			continue
+		}
+		results, err := user.service.repository.MessagesFindManyByRoomIdAfter(
+			context.Background(),
+			repository.MessagesFindManyByRoomIdAfterParams{
+				RoomId:    cursor.RoomId,
+				MessageId: cursor.MessageId,
+				Limit:     REPLAY_LIMIT + 1,
+			},
+		)
+		if err != nil {
+			slog.Error("error finding replay messages", "cursor", cursor)
+			continue
+		}
+		truncated := len(results) > REPLAY_LIMIT
+		if truncated {
+			results = results[:REPLAY_LIMIT]
+		}
+		for _, result := range results {
+			frame := mustNewFrame(
+				FRAME_MESSAGE_NEW,
+				"",
+				newMessageFromFindMany(result),
+			)
+			if err := user.write(frame); err != nil {
+				return err
+			}
+		}
+		frame := mustNewFrame(FRAME_REPLAY_DONE, "", replayDonePayload{
+			RoomId:    cursor.RoomId.String(),
+			Truncated: truncated,
+		})
+		if err := user.write(frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
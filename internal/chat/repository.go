@@ -0,0 +1,64 @@
+package chat
+
+import (
+	"context"
+	"gossip/internal/repository"
+)
+
+// the part of the repository the chat service depends on, satisfied by
+// *repository.Repository
+type Repository interface {
+	RoomFindMany(ctx context.Context) ([]repository.RoomFindManyResult, error)
+	UsersFindManyByRoomId(
+		ctx context.Context,
+		dto repository.UsersFindManyByRoomIdParams,
+	) ([]repository.UsersFindManyByRoomIdResult, error)
+	UserCheckRoomMembership(
+		ctx context.Context,
+		dto repository.UserCheckRoomMembershipParams,
+	) (bool, error)
+	UserPresenceUpdate(
+		ctx context.Context,
+		dto repository.UserPresenceUpdateParams,
+	) (repository.UserPresenceUpdateResult, error)
+	UsersLastSeenTouch(
+		ctx context.Context,
+		dto repository.UsersLastSeenTouchParams,
+	) error
+	RoomReadUpdate(
+		ctx context.Context,
+		dto repository.RoomReadUpdateParams,
+	) (bool, error)
+	MessageSave(
+		ctx context.Context,
+		dto repository.MessageSaveParams,
+	) (repository.MessageSaveResult, error)
+	MessageFindOne(
+		ctx context.Context,
+		dto repository.MessageFindOneParams,
+	) (repository.MessageFindOneResult, error)
+	MessagesFindManyByRoomId(
+		ctx context.Context,
+		dto repository.MessagesFindManyByRoomIdParams,
+	) ([]repository.MessagesFindManyByRoomIdResult, error)
+	MessagesFindManyByRoomIdAfter(
+		ctx context.Context,
+		dto repository.MessagesFindManyByRoomIdAfterParams,
+	) ([]repository.MessagesFindManyByRoomIdResult, error)
+	MessageUpdate(
+		ctx context.Context,
+		dto repository.MessageUpdateParams,
+	) (bool, error)
+	MessageDelete(
+		ctx context.Context,
+		dto repository.MessageDeleteParams,
+	) (bool, error)
+	ReactionAdd(
+		ctx context.Context,
+		dto repository.ReactionAddParams,
+	) (bool, error)
+	ReactionRemove(
+		ctx context.Context,
+		dto repository.ReactionRemoveParams,
+	) (bool, error)
+}
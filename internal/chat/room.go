@@ -2,17 +2,31 @@ package chat
 
 import (
 	"context"
+	"errors"
 	"gossip/internal/repository"
 	"log/slog"
+	"time"
 
 	"github.com/gofrs/uuid/v5"
+	"github.com/jackc/pgx/v5"
 )
 
 type room struct {
 	roomId  uuid.UUID
 	service *Service
 	ingress chan event
+	done    chan struct{}
 	userIds map[uuid.UUID]bool
+	typists map[uuid.UUID]*typist
+	// the latest message delivered, from which the room resyncs; nil while
+	// the room has no messages
+	lastMessageId *uuid.UUID
+}
+
+// a member currently typing, cleared when its timer fires
+type typist struct {
+	username string
+	timer    *time.Timer
 }
 
 func newRoom(service *Service, roomId uuid.UUID) (*room, error) {
@@ -20,7 +34,9 @@ func newRoom(service *Service, roomId uuid.UUID) (*room, error) {
 		roomId:  roomId,
 		service: service,
 		ingress: make(chan event),
+		done:    make(chan struct{}),
 		userIds: make(map[uuid.UUID]bool),
+		typists: make(map[uuid.UUID]*typist),
 	}
 	results, err := service.repository.UsersFindManyByRoomId(
 		context.Background(),
@@ -32,66 +48,661 @@ func newRoom(service *Service, roomId uuid.UUID) (*room, error) {
 	for _, result := range results {
 		room.userIds[result.UserId] = true
 	}
+	messages, err := service.repository.MessagesFindManyByRoomId(
+		context.Background(),
+		repository.MessagesFindManyByRoomIdParams{RoomId: roomId, Limit: 1},
+	)
+	if err != nil {
+		return nil, err
+	}
+	if len(messages) > 0 {
+		room.lastMessageId = &messages[0].MessageId
+	}
 	go room.receiveEvents()
 	return room, nil
 }
 
 func (room *room) receiveEvents() {
+	defer close(room.done)
 	for {
-		event, ok := <-room.ingress
+		var event event
+		select {
+		case <-room.service.ctx.Done():
+			return
+		case event = <-room.ingress:
+		}
 		slog.Info("room received event", "event", event)
-		if !ok {
+		if _, ok := event.(roomClosedEvent); ok {
+			room.roomClosedEventHandler()
 			return
 		}
 		room.eventHandler(event)
 	}
 }
 
+// returns false once the room has stopped receiving events
+func (room *room) push(event event) bool {
+	select {
+	case <-room.done:
+		return false
+	case room.ingress <- event:
+		return true
+	}
+}
+
 // event management
 
 func (room *room) eventHandler(event event) {
+	if room.refuseWhileStopping(event) {
+		return
+	}
 	switch event := event.(type) {
 	case messageEvent:
 		room.messageEventHandler(event)
+	case remoteMessageEvent:
+		room.remoteMessageEventHandler(event)
+	case messageEditEvent:
+		room.messageEditEventHandler(event)
+	case messageDeleteEvent:
+		room.messageDeleteEventHandler(event)
+	case reactionEvent:
+		room.reactionEventHandler(event)
+	case remoteReactionEvent:
+		room.remoteReactionEventHandler(event)
+	case typingEvent:
+		room.typingEventHandler(event)
+	case typingExpiredEvent:
+		room.typingExpiredEventHandler(event)
+	case readReceiptEvent:
+		room.readReceiptEventHandler(event)
 	case userJoinedRoomEvent:
 		room.userJoinedRoomEventHandler(event)
 	case userLeftRoomEvent:
 		room.userLeftRoomEventHandler(event)
+	case roomRenamedEvent:
+		room.roomRenamedEventHandler(event)
+	case presenceEvent:
+		room.presenceEventHandler(event)
+	case roomResyncEvent:
+		room.roomResyncEventHandler()
+	case roomDrainedEvent:
 	default:
 		slog.Error("invalid event", "event", event)
 	}
 }
 
+// events from local clients that reach the room once shutting down has begun
+// are refused like the frames refused by their connections, so that clients
+// resend them once reconnected elsewhere
+func (room *room) refuseWhileStopping(event event) bool {
+	if !room.service.stopping.Load() {
+		return false
+	}
+	switch event := event.(type) {
+	case messageEvent:
+		event.sender.sendServiceError(event.frameId, ShuttingDownError)
+	case reactionEvent:
+		event.sender.sendServiceError(event.frameId, ShuttingDownError)
+	case typingEvent:
+		if event.remote {
+			return false
+		}
+		event.sender.sendServiceError(event.frameId, ShuttingDownError)
+	case readReceiptEvent:
+		if event.remote {
+			return false
+		}
+		event.sender.sendServiceError(event.frameId, ShuttingDownError)
+	case messageEditEvent:
+		event.done <- ShuttingDownError
+	case messageDeleteEvent:
+		event.done <- ShuttingDownError
+	default:
+		return false
+	}
+	return true
+}
+
 func (room *room) messageEventHandler(event messageEvent) {
-	if err := room.service.repository.MessageSave(
+	if !room.authorize(event.userId, event.sender, event.frameId) {
+		return
+	}
+	// charged once authorized, so that outsiders cannot spend the budget
+	if !event.sender.allow(event.frameId, room.service.roomLimiter, room.roomId) {
+		return
+	}
+	var clientId *string
+	if event.payload.ClientId != "" {
+		clientId = &event.payload.ClientId
+	}
+	result, err := room.service.repository.MessageSave(
 		context.Background(),
 		repository.MessageSaveParams{
-			UserId: event.userId,
-			RoomId: event.roomId,
-			Body:   event.payload.Body,
+			UserId:   event.userId,
+			RoomId:   event.roomId,
+			Body:     event.payload.Body,
+			ClientId: clientId,
+			ParentId: event.parentId,
+		},
+	)
+	if errors.Is(err, pgx.ErrNoRows) {
+		event.sender.sendError(
+			event.frameId,
+			ERROR_MESSAGE_NOT_FOUND,
+			"parent message not found",
+		)
+		return
+	}
+	if err != nil {
+		slog.Error(
+			"error saving message",
+			"error", err.Error(),
+			"message", event.payload,
+		)
+		event.sender.sendError(
+			event.frameId,
+			ERROR_SAVE_FAILED,
+			"message could not be saved",
+		)
+		return
+	}
+	event.payload.MessageId = result.MessageId.String()
+	event.payload.Timestamp = result.Timestamp
+	if result.ParentId != nil {
+		room.quoteParent(event.payload, *result.ParentId)
+	}
+	if !result.Duplicate {
+		if _, ok := room.typists[event.userId]; ok {
+			room.typingEventHandler(typingEvent{userId: event.userId})
+		}
+		room.deliverNew(
+			event.userId,
+			mustNewFrame(FRAME_MESSAGE_NEW, "", event.payload),
+		)
+		room.lastMessageId = &result.MessageId
+		room.service.publish(broadcast{
+			Kind:      BROADCAST_MESSAGE_SAVED,
+			RoomId:    room.roomId,
+			MessageId: result.MessageId,
+		})
+	}
+	event.sender.sendFrame(FRAME_ACK, event.frameId, ackPayload{
+		ClientId:  event.payload.ClientId,
+		MessageId: event.payload.MessageId,
+		Timestamp: event.payload.Timestamp,
+	})
+}
+
+func (room *room) quoteParent(message *message, parentId uuid.UUID) {
+	parent, err := room.service.repository.MessageFindOne(
+		context.Background(),
+		repository.MessageFindOneParams{MessageId: parentId},
+	)
+	if err != nil {
+		slog.Error("error finding parent message", "parentId", parentId)
+		return
+	}
+	parentIdValue := parentId.String()
+	message.ParentId = &parentIdValue
+	message.ParentUsername = &parent.Username
+	message.ParentBody = &parent.Body
+}
+
+func (room *room) remoteMessageEventHandler(event remoteMessageEvent) {
+	room.deliverMessage(event.frameType, event.messageId)
+	if event.frameType == FRAME_MESSAGE_NEW {
+		room.lastMessageId = &event.messageId
+	}
+}
+
+// delivers the messages saved since the last one delivered; edits and
+// deletes that were missed are only picked up by clients reloading the room
+func (room *room) roomResyncEventHandler() {
+	for {
+		results, err := room.service.repository.MessagesFindManyByRoomIdAfter(
+			context.Background(),
+			repository.MessagesFindManyByRoomIdAfterParams{
+				RoomId:    room.roomId,
+				MessageId: room.lastMessageId,
+				Limit:     REPLAY_LIMIT,
+			},
+		)
+		if err != nil {
+			slog.Error("error resyncing room", "roomId", room.roomId)
+			return
+		}
+		for _, result := range results {
+			room.deliverNew(result.UserId, mustNewFrame(
+				FRAME_MESSAGE_NEW,
+				"",
+				newMessageFromFindMany(result),
+			))
+			messageId := result.MessageId
+			room.lastMessageId = &messageId
+		}
+		if len(results) < REPLAY_LIMIT {
+			return
+		}
+	}
+}
+
+func (room *room) messageEditEventHandler(event messageEditEvent) {
+	if !room.isMember(event.userId) {
+		room.reject(event.userId)
+		event.done <- NotRoomMemberError
+		return
+	}
+	updated, err := room.service.repository.MessageUpdate(
+		context.Background(),
+		repository.MessageUpdateParams{
+			MessageId: event.messageId,
+			RoomId:    room.roomId,
+			UserId:    event.userId,
+			Body:      event.body,
 		},
-	); err != nil {
-		slog.Error("error saving message", "message", event.payload)
+	)
+	if err != nil {
+		slog.Error("error updating message", "messageId", event.messageId)
+		event.done <- err
+		return
 	}
+	if !updated {
+		event.done <- MessageNotFoundError
+		return
+	}
+	event.done <- nil
+	room.deliverMessage(FRAME_MESSAGE_EDITED, event.messageId)
+	room.service.publish(broadcast{
+		Kind:      BROADCAST_MESSAGE_EDITED,
+		RoomId:    room.roomId,
+		MessageId: event.messageId,
+	})
+}
+
+func (room *room) messageDeleteEventHandler(event messageDeleteEvent) {
+	if !room.isMember(event.userId) {
+		room.reject(event.userId)
+		event.done <- NotRoomMemberError
+		return
+	}
+	deleted, err := room.service.repository.MessageDelete(
+		context.Background(),
+		repository.MessageDeleteParams{
+			MessageId: event.messageId,
+			RoomId:    room.roomId,
+			UserId:    event.userId,
+		},
+	)
+	if err != nil {
+		slog.Error("error deleting message", "messageId", event.messageId)
+		event.done <- err
+		return
+	}
+	if !deleted {
+		event.done <- MessageNotFoundError
+		return
+	}
+	event.done <- nil
+	room.deliverMessage(FRAME_MESSAGE_DELETED, event.messageId)
+	room.service.publish(broadcast{
+		Kind:      BROADCAST_MESSAGE_DELETED,
+		RoomId:    room.roomId,
+		MessageId: event.messageId,
+	})
+}
+
+// loads the current state of a message and delivers it to every member
+func (room *room) deliverMessage(frameType string, messageId uuid.UUID) {
+	result, err := room.service.repository.MessageFindOne(
+		context.Background(),
+		repository.MessageFindOneParams{MessageId: messageId},
+	)
+	if err != nil {
+		slog.Error("error finding message", "messageId", messageId)
+		return
+	}
+	frame := mustNewFrame(frameType, "", newMessageFromFindOne(result))
+	if frameType == FRAME_MESSAGE_NEW {
+		room.deliverNew(result.UserId, frame)
+		return
+	}
+	room.deliver(frame)
+}
+
+func (room *room) reactionEventHandler(event reactionEvent) {
+	if !room.authorize(event.userId, event.sender, event.frameId) {
+		return
+	}
+	var changed bool
+	var err error
+	if event.added {
+		changed, err = room.service.repository.ReactionAdd(
+			context.Background(),
+			repository.ReactionAddParams{
+				MessageId: event.messageId,
+				RoomId:    room.roomId,
+				UserId:    event.userId,
+				Emoji:     event.emoji,
+			},
+		)
+	} else {
+		changed, err = room.service.repository.ReactionRemove(
+			context.Background(),
+			repository.ReactionRemoveParams{
+				MessageId: event.messageId,
+				RoomId:    room.roomId,
+				UserId:    event.userId,
+				Emoji:     event.emoji,
+			},
+		)
+	}
+	if err != nil {
+		slog.Error(
+			"error saving reaction",
+			"error", err.Error(),
+			"messageId", event.messageId,
+		)
+		event.sender.sendError(
+			event.frameId,
+			ERROR_SAVE_FAILED,
+			"reaction could not be saved",
+		)
+		return
+	}
+	event.sender.sendFrame(FRAME_ACK, event.frameId, nil)
+	if !changed {
+		return
+	}
+	room.remoteReactionEventHandler(remoteReactionEvent{
+		userId:    event.userId,
+		messageId: event.messageId,
+		emoji:     event.emoji,
+		added:     event.added,
+	})
+	kind := BROADCAST_REACTION_REMOVED
+	if event.added {
+		kind = BROADCAST_REACTION_ADDED
+	}
+	room.service.publish(broadcast{
+		Kind:      kind,
+		RoomId:    room.roomId,
+		UserId:    event.userId,
+		MessageId: event.messageId,
+		Emoji:     event.emoji,
+	})
+}
+
+func (room *room) remoteReactionEventHandler(event remoteReactionEvent) {
+	frameType := FRAME_REACTION_REMOVED
+	if event.added {
+		frameType = FRAME_REACTION_ADDED
+	}
+	room.deliver(mustNewFrame(frameType, "", reactionPayload{
+		RoomId:    room.roomId.String(),
+		MessageId: event.messageId.String(),
+		UserId:    event.userId.String(),
+		Emoji:     event.emoji,
+	}))
+}
+
+// typing is ephemeral: it is fanned out and expired here but never saved
+func (room *room) typingEventHandler(event typingEvent) {
+	if !event.remote && !room.authorize(event.userId, event.sender, event.frameId) {
+		return
+	}
+	if !room.userIds[event.userId] {
+		return
+	}
+	if !event.remote {
+		room.service.publish(broadcast{
+			Kind:   BROADCAST_TYPING,
+			RoomId: room.roomId,
+			UserId: event.userId,
+			Name:   event.username,
+			Typing: event.typing,
+		})
+	}
+	if !event.typing {
+		room.stopTyping(event.userId)
+		return
+	}
+	existing, wasTyping := room.typists[event.userId]
+	if wasTyping {
+		existing.timer.Stop()
+	}
+	// a fresh typist per refresh so a stale timer cannot clear a newer one
+	typist := &typist{username: event.username}
+	typist.timer = time.AfterFunc(TYPING_TIMEOUT, func() {
+		room.push(typingExpiredEvent{userId: event.userId, typist: typist})
+	})
+	room.typists[event.userId] = typist
+	if !wasTyping {
+		room.deliverTyping(event.userId, event.username, true)
+	}
+}
+
+func (room *room) typingExpiredEventHandler(event typingExpiredEvent) {
+	if room.typists[event.userId] != event.typist {
+		return
+	}
+	delete(room.typists, event.userId)
+	room.deliverTyping(event.userId, event.typist.username, false)
+}
+
+func (room *room) stopTyping(userId uuid.UUID) {
+	typist, ok := room.typists[userId]
+	if !ok {
+		return
+	}
+	typist.timer.Stop()
+	delete(room.typists, userId)
+	room.deliverTyping(userId, typist.username, false)
+}
+
+func (room *room) deliverTyping(userId uuid.UUID, username string, typing bool) {
+	frame := mustNewFrame(FRAME_TYPING, "", typingPayload{
+		RoomId:   room.roomId.String(),
+		UserId:   userId.String(),
+		Username: username,
+		Typing:   typing,
+	})
+	room.deliverExcept(userId, frame)
+}
+
+// remote receipts were already saved by the instance that received them
+func (room *room) readReceiptEventHandler(event readReceiptEvent) {
+	if !event.remote {
+		if !room.authorize(event.userId, event.sender, event.frameId) {
+			return
+		}
+		advanced, err := room.service.repository.RoomReadUpdate(
+			context.Background(),
+			repository.RoomReadUpdateParams{
+				UserId:    event.userId,
+				RoomId:    room.roomId,
+				MessageId: event.messageId,
+			},
+		)
+		if err != nil {
+			slog.Error(
+				"error saving read receipt",
+				"error", err.Error(),
+				"messageId", event.messageId,
+			)
+			event.sender.sendError(
+				event.frameId,
+				ERROR_SAVE_FAILED,
+				"read receipt could not be saved",
+			)
+			return
+		}
+		event.sender.sendFrame(FRAME_ACK, event.frameId, nil)
+		if !advanced {
+			return
+		}
+		room.service.publish(broadcast{
+			Kind:      BROADCAST_READ,
+			RoomId:    room.roomId,
+			UserId:    event.userId,
+			MessageId: event.messageId,
+		})
+	}
+	// the reader's other tabs need the receipt too, to clear their unread state
+	room.deliver(mustNewFrame(FRAME_READ, "", readReceiptPayload{
+		RoomId:    room.roomId.String(),
+		MessageId: event.messageId.String(),
+		UserId:    event.userId.String(),
+	}))
+}
+
+func (room *room) deliver(frame *frame) {
+	room.deliverExcept(uuid.Nil, frame)
+}
+
+// sends the frame to every subscribed connection of the members
+func (room *room) deliverExcept(exceptUserId uuid.UUID, frame *frame) {
 	for userId := range room.userIds {
-		user, ok := room.service.users[userId]
-		if !ok {
-			slog.Error("user not found", "userId", userId)
+		if userId == exceptUserId {
 			continue
 		}
-		if !user.alive {
-			slog.Info("user not alive", "userId", userId)
-			continue
+		for _, user := range room.service.connections(userId) {
+			if !user.alive() {
+				continue
+			}
+			user.deliver(room.roomId, frame, nil)
+		}
+	}
+}
+
+// sends a new message to every subscribed connection of the members, and an
+// activity notification to their other connections, apart from the
+// author's, to whom their own message is not news
+func (room *room) deliverNew(authorId uuid.UUID, frame *frame) {
+	activity := mustNewFrame(FRAME_ROOM_ACTIVITY, "", subscriptionPayload{
+		RoomId: room.roomId.String(),
+	})
+	for userId := range room.userIds {
+		activity := activity
+		if userId == authorId {
+			activity = nil
+		}
+		for _, user := range room.service.connections(userId) {
+			if !user.alive() {
+				continue
+			}
+			user.deliver(room.roomId, frame, activity)
+		}
+	}
+}
+
+// checks the in-memory membership first, falling back to the repository for
+// members whose join has not reached this instance yet
+func (room *room) isMember(userId uuid.UUID) bool {
+	if room.userIds[userId] {
+		return true
+	}
+	isMember, err := room.service.repository.UserCheckRoomMembership(
+		context.Background(),
+		repository.UserCheckRoomMembershipParams{
+			UserId: userId,
+			RoomId: room.roomId,
+		},
+	)
+	if err != nil {
+		slog.Error("error checking room membership", "error", err.Error())
+		return false
+	}
+	if isMember {
+		room.userIds[userId] = true
+	}
+	return isMember
+}
+
+// sends the sender an error frame when it is not a member of the room
+func (room *room) authorize(userId uuid.UUID, sender *user, frameId string) bool {
+	if room.isMember(userId) {
+		return true
+	}
+	room.reject(userId)
+	sender.sendError(frameId, ERROR_NOT_ROOM_MEMBER, NotRoomMemberError.Error())
+	return false
+}
+
+func (room *room) reject(userId uuid.UUID) {
+	rejectedSends.Add(1)
+	slog.Warn(
+		"rejected frame from non-member",
+		"userId", userId,
+		"roomId", room.roomId,
+	)
+}
+
+// sends membership and lifecycle frames to every connection of the members,
+// subscribed or not
+func (room *room) notify(frame *frame) {
+	for userId := range room.userIds {
+		for _, user := range room.service.connections(userId) {
+			if !user.alive() {
+				continue
+			}
+			user.push(frame)
 		}
-		slog.Info("user found", "userId", userId)
-		user.send <- event.payload
 	}
 }
 
 func (room *room) userJoinedRoomEventHandler(event userJoinedRoomEvent) {
 	room.userIds[event.userId] = true
+	room.deliver(mustNewFrame(FRAME_ROOM_JOINED, "", membershipPayload{
+		RoomId: room.roomId.String(),
+		UserId: event.userId.String(),
+	}))
 }
 
 func (room *room) userLeftRoomEventHandler(event userLeftRoomEvent) {
+	frameType := FRAME_ROOM_LEFT
+	if event.kicked {
+		frameType = FRAME_ROOM_KICKED
+	}
+	room.notify(mustNewFrame(frameType, "", membershipPayload{
+		RoomId: room.roomId.String(),
+		UserId: event.userId.String(),
+	}))
+	// sockets open on the room go, once the frame explaining why is sent
+	if event.kicked {
+		for _, user := range room.service.connections(event.userId) {
+			if user.subscribed(room.roomId) {
+				user.close(CLOSE_KICKED, "kicked from room")
+			}
+		}
+	}
+	room.stopTyping(event.userId)
 	delete(room.userIds, event.userId)
 }
+
+func (room *room) roomRenamedEventHandler(event roomRenamedEvent) {
+	room.notify(mustNewFrame(FRAME_ROOM_RENAMED, "", roomPayload{
+		RoomId: room.roomId.String(),
+		Name:   event.name,
+	}))
+}
+
+func (room *room) presenceEventHandler(event presenceEvent) {
+	if !room.userIds[event.userId] {
+		return
+	}
+	room.deliverExcept(event.userId, mustNewFrame(
+		FRAME_PRESENCE,
+		"",
+		presencePayload{
+			UserId:   event.userId.String(),
+			Username: event.username,
+			Presence: event.presence,
+		},
+	))
+}
+
+func (room *room) roomClosedEventHandler() {
+	room.notify(mustNewFrame(FRAME_ROOM_DELETED, "", roomPayload{
+		RoomId: room.roomId.String(),
+	}))
+}
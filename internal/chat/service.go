@@ -2,13 +2,28 @@ package chat
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"gossip/internal/repository"
+	"gossip/internal/utils/ratelimit"
 	"log/slog"
 	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gofrs/uuid/v5"
 	"github.com/gorilla/websocket"
+	"github.com/jackc/pgx/v5"
+)
+
+var (
+	RoomNotFoundError     = errors.New("room not found")
+	MessageNotFoundError  = errors.New("message not found")
+	NotMessageAuthorError = errors.New("not the author of this message")
+	EmptyMessageError     = errors.New("message body is empty")
+	NotRoomMemberError    = errors.New("not a member of this room")
+	ShuttingDownError     = errors.New("server is shutting down")
 )
 
 var upgrader = websocket.Upgrader{
@@ -16,65 +31,395 @@ var upgrader = websocket.Upgrader{
 	WriteBufferSize: BUFFER_SIZE,
 }
 
+// tuning knobs, zero values fall back to the defaults in constants.go; a
+// negative rate interval turns that limit off
+type Options struct {
+	SendQueueSize  int
+	OverflowPolicy string
+	WriteWait      time.Duration
+	PongWait       time.Duration
+	PingPeriod     time.Duration
+	UserRate       ratelimit.Params
+	RoomRate       ratelimit.Params
+}
+
+func (options Options) withDefaults() (Options, error) {
+	if options.SendQueueSize <= 0 {
+		options.SendQueueSize = SEND_QUEUE_SIZE
+	}
+	switch options.OverflowPolicy {
+	case "":
+		options.OverflowPolicy = DEFAULT_OVERFLOW_POLICY
+	case OVERFLOW_DROP_OLDEST, OVERFLOW_COALESCE, OVERFLOW_DISCONNECT:
+	default:
+		return options, fmt.Errorf(
+			"invalid overflow policy: %s",
+			options.OverflowPolicy,
+		)
+	}
+	if options.WriteWait <= 0 {
+		options.WriteWait = WRITE_WAIT
+	}
+	if options.PongWait <= 0 {
+		options.PongWait = PONG_WAIT
+	}
+	if options.PingPeriod <= 0 {
+		options.PingPeriod = PING_PERIOD
+		if options.PongWait != PONG_WAIT {
+			// the same ratio as PING_PERIOD to PONG_WAIT
+			options.PingPeriod = options.PongWait * 9 / 10
+		}
+	}
+	if options.UserRate.Interval == 0 {
+		options.UserRate.Interval = USER_RATE_INTERVAL
+	}
+	if options.UserRate.Burst <= 0 {
+		options.UserRate.Burst = USER_RATE_BURST
+	}
+	if options.UserRate.MuteAfter <= 0 {
+		options.UserRate.MuteAfter = MUTE_AFTER
+	}
+	if options.UserRate.MuteDuration <= 0 {
+		options.UserRate.MuteDuration = MUTE_DURATION
+	}
+	if options.RoomRate.Interval == 0 {
+		options.RoomRate.Interval = ROOM_RATE_INTERVAL
+	}
+	if options.RoomRate.Burst <= 0 {
+		options.RoomRate.Burst = ROOM_RATE_BURST
+	}
+	// throttled rooms are busy rather than abused, nobody is muted for it
+	options.RoomRate.MuteAfter = 0
+	if options.PingPeriod >= options.PongWait {
+		return options, fmt.Errorf(
+			"ping period %s must be less than pong wait %s",
+			options.PingPeriod,
+			options.PongWait,
+		)
+	}
+	return options, nil
+}
+
 type Service struct {
+	instanceId uuid.UUID
+	options    Options
 	ingress    chan event
-	repository *repository.Repository
-	users      map[uuid.UUID]*user
-	rooms      map[uuid.UUID]*room
+	// cancelled once shut down, stopping the service and room goroutines
+	ctx    context.Context
+	cancel context.CancelFunc
+	// set when shutting down starts, after which no frames are accepted
+	stopping atomic.Bool
+	// shared by every connection on this instance
+	userLimiter *ratelimit.Limiter
+	roomLimiter *ratelimit.Limiter
+	repository  Repository
+	broadcaster Broadcaster
+	// both maps are only written by the service goroutine, which holds the
+	// write lock to do so; rooms and users read them under the read lock
+	usersMu sync.RWMutex
+	// every live connection of each connected user
+	users   map[uuid.UUID]map[*user]bool
+	roomsMu sync.RWMutex
+	rooms   map[uuid.UUID]*room
 }
 
-func NewService(repository *repository.Repository) (*Service, error) {
+func NewService(
+	repository Repository,
+	broadcaster Broadcaster,
+	options Options,
+) (*Service, error) {
+	options, err := options.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	instanceId, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
 	service := &Service{
-		ingress:    make(chan event),
-		repository: repository,
-		users:      make(map[uuid.UUID]*user),
-		rooms:      make(map[uuid.UUID]*room),
+		instanceId:  instanceId,
+		options:     options,
+		ingress:     make(chan event),
+		ctx:         ctx,
+		cancel:      cancel,
+		userLimiter: ratelimit.New(options.UserRate),
+		roomLimiter: ratelimit.New(options.RoomRate),
+		repository:  repository,
+		broadcaster: broadcaster,
+		users:       make(map[uuid.UUID]map[*user]bool),
+		rooms:       make(map[uuid.UUID]*room),
+	}
+	payloads, err := broadcaster.Subscribe(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
 	}
 	service.initRooms()
 	go service.receiveEvents()
+	go service.receiveBroadcasts(payloads)
+	go service.heartbeatPresence()
 	return service, nil
 }
 
+// the client ID identifies a single page load, so that a client reconnecting
+// with it replaces its previous connection instead of waiting for it to time
+// out
+type UserConnectParams struct {
+	UserId    uuid.UUID
+	Username  string
+	SessionId uuid.UUID
+	ClientId  string
+	Cursors   []Cursor
+}
+
 func (service *Service) UserConnect(
 	w http.ResponseWriter,
 	r *http.Request,
-	userId uuid.UUID,
-	username string,
+	params UserConnectParams,
 ) error {
+	if service.stopping.Load() {
+		return ShuttingDownError
+	}
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		return err
 	}
-	user := newUser(service, conn, userId, username)
-	service.ingress <- userConnectedEvent{user: user}
+	user := newUser(service, conn, params)
+	if !service.push(userConnectedEvent{user: user}) {
+		conn.Close()
+	}
+	return nil
+}
+
+// stops accepting frames, lets every room finish saving what it was given,
+// then closes every connection asking its client to reconnect, which it
+// waits for until ctx is done
+func (service *Service) Shutdown(ctx context.Context) error {
+	defer service.cancel()
+	service.stopping.Store(true)
+	slog.Info("shutting down chat service")
+	if err := service.drainRooms(ctx); err != nil {
+		return err
+	}
+	stopped := make(chan []*user, 1)
+	if !service.push(shutdownEvent{stopped: stopped}) {
+		return nil
+	}
+	var users []*user
+	select {
+	case users = <-stopped:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	for _, user := range users {
+		select {
+		case <-user.stopped:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	slog.Info("chat service shut down", "connections", len(users))
 	return nil
 }
 
+// rooms handle events in order, so once one takes the barrier everything
+// pushed to it before has been handled
+func (service *Service) drainRooms(ctx context.Context) error {
+	var wg sync.WaitGroup
+	for _, room := range service.allRooms() {
+		room := room
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			room.push(roomDrainedEvent{})
+		}()
+	}
+	drained := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// closes every socket opened with the session, on every instance
+func (service *Service) UserLogout(userId uuid.UUID, sessionId uuid.UUID) {
+	service.push(userLoggedOutEvent{userId: userId, sessionId: sessionId})
+	service.publish(broadcast{
+		Kind:      BROADCAST_LOGGED_OUT,
+		UserId:    userId,
+		SessionId: sessionId,
+	})
+}
+
 func (service *Service) RoomCreate(roomId uuid.UUID) error {
 	room, err := newRoom(service, roomId)
 	if err != nil {
 		return err
 	}
-	service.ingress <- roomCreatedEvent{room: room}
+	service.push(roomCreatedEvent{room: room})
+	service.publish(broadcast{Kind: BROADCAST_ROOM_CREATED, RoomId: roomId})
 	return nil
 }
 
 func (service *Service) UserJoinRoom(userId uuid.UUID, roomId uuid.UUID) {
-	room, ok := service.rooms[roomId]
+	service.roomIngress(roomId, userJoinedRoomEvent{userId: userId})
+	service.publish(broadcast{
+		Kind:   BROADCAST_USER_JOINED,
+		RoomId: roomId,
+		UserId: userId,
+	})
+}
+
+func (service *Service) UserLeaveRoom(userId uuid.UUID, roomId uuid.UUID) {
+	service.roomIngress(roomId, userLeftRoomEvent{userId: userId})
+	service.publish(broadcast{
+		Kind:   BROADCAST_USER_LEFT,
+		RoomId: roomId,
+		UserId: userId,
+	})
+}
+
+func (service *Service) UserKick(userId uuid.UUID, roomId uuid.UUID) {
+	service.roomIngress(roomId, userLeftRoomEvent{userId: userId, kicked: true})
+	service.publish(broadcast{
+		Kind:   BROADCAST_USER_KICKED,
+		RoomId: roomId,
+		UserId: userId,
+	})
+}
+
+func (service *Service) RoomRename(roomId uuid.UUID, name string) {
+	service.roomIngress(roomId, roomRenamedEvent{name: name})
+	service.publish(broadcast{
+		Kind:   BROADCAST_ROOM_RENAMED,
+		RoomId: roomId,
+		Name:   name,
+	})
+}
+
+func (service *Service) RoomDelete(roomId uuid.UUID) {
+	service.push(roomDeletedEvent{roomId: roomId})
+	service.publish(broadcast{Kind: BROADCAST_ROOM_DELETED, RoomId: roomId})
+}
+
+func (service *Service) MessageEdit(
+	userId uuid.UUID,
+	messageId uuid.UUID,
+	body string,
+) error {
+	if body == "" {
+		return EmptyMessageError
+	}
+	roomId, err := service.authoredMessageRoomId(userId, messageId)
+	if err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	if !service.roomIngress(roomId, messageEditEvent{
+		userId:    userId,
+		messageId: messageId,
+		body:      body,
+		done:      done,
+	}) {
+		return service.roomStoppedError()
+	}
+	return <-done
+}
+
+func (service *Service) MessageDelete(
+	userId uuid.UUID,
+	messageId uuid.UUID,
+) error {
+	roomId, err := service.authoredMessageRoomId(userId, messageId)
+	if err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	if !service.roomIngress(roomId, messageDeleteEvent{
+		userId:    userId,
+		messageId: messageId,
+		done:      done,
+	}) {
+		return service.roomStoppedError()
+	}
+	return <-done
+}
+
+// rooms stop receiving events when deleted or once shut down, the latter
+// being worth retrying elsewhere
+func (service *Service) roomStoppedError() error {
+	if service.stopping.Load() {
+		return ShuttingDownError
+	}
+	return RoomNotFoundError
+}
+
+func (service *Service) authoredMessageRoomId(
+	userId uuid.UUID,
+	messageId uuid.UUID,
+) (uuid.UUID, error) {
+	result, err := service.repository.MessageFindOne(
+		context.Background(),
+		repository.MessageFindOneParams{MessageId: messageId},
+	)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return uuid.Nil, MessageNotFoundError
+	}
+	if err != nil {
+		return uuid.Nil, err
+	}
+	if result.DeletedAt != nil {
+		return uuid.Nil, MessageNotFoundError
+	}
+	if result.UserId != userId {
+		return uuid.Nil, NotMessageAuthorError
+	}
+	return result.RoomId, nil
+}
+
+func (service *Service) roomIngress(roomId uuid.UUID, event event) bool {
+	room, ok := service.room(roomId)
 	if !ok {
 		slog.Error("room not found", "roomId", roomId)
-		return
+		return false
 	}
-	room.ingress <- userJoinedRoomEvent{userId: userId}
+	return room.push(event)
 }
 
-func (service *Service) UserLeaveRoom(userId uuid.UUID, roomId uuid.UUID) {
+func (service *Service) room(roomId uuid.UUID) (*room, bool) {
+	service.roomsMu.RLock()
+	defer service.roomsMu.RUnlock()
 	room, ok := service.rooms[roomId]
-	if !ok {
-		slog.Error("room not found", "roomId", roomId)
-		return
+	return room, ok
+}
+
+// a snapshot, so that pushing to the rooms happens outside the lock
+func (service *Service) allRooms() []*room {
+	service.roomsMu.RLock()
+	defer service.roomsMu.RUnlock()
+	rooms := make([]*room, 0, len(service.rooms))
+	for _, room := range service.rooms {
+		rooms = append(rooms, room)
+	}
+	return rooms
+}
+
+// a snapshot of the live connections of a user
+func (service *Service) connections(userId uuid.UUID) []*user {
+	service.usersMu.RLock()
+	defer service.usersMu.RUnlock()
+	connections := make([]*user, 0, len(service.users[userId]))
+	for user := range service.users[userId] {
+		connections = append(connections, user)
 	}
-	room.ingress <- userLeftRoomEvent{userId: userId}
+	return connections
 }
 
 func (service *Service) initRooms() {
@@ -90,19 +435,46 @@ func (service *Service) initRooms() {
 		room, err := newRoom(service, result.RoomId)
 		if err != nil {
 			slog.Error("error initing room", "roomId", result.RoomId)
+			continue
 		}
+		service.roomsMu.Lock()
 		service.rooms[result.RoomId] = room
+		service.roomsMu.Unlock()
 		slog.Info("inited room", "roomId", result.RoomId)
 	}
 }
 
+func (service *Service) heartbeatPresence() {
+	ticker := time.NewTicker(PRESENCE_HEARTBEAT)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-service.ctx.Done():
+			return
+		case <-ticker.C:
+			service.push(presenceHeartbeatEvent{})
+		}
+	}
+}
+
 func (service *Service) receiveEvents() {
 	for {
-		event, ok := <-service.ingress
-		if !ok {
+		select {
+		case <-service.ctx.Done():
 			return
+		case event := <-service.ingress:
+			service.eventHandler(event)
 		}
-		service.eventHandler(event)
+	}
+}
+
+// returns false once the service has shut down
+func (service *Service) push(event event) bool {
+	select {
+	case <-service.ctx.Done():
+		return false
+	case service.ingress <- event:
+		return true
 	}
 }
 
@@ -112,44 +484,215 @@ func (s *Service) eventHandler(event event) {
 	switch event := event.(type) {
 	case roomCreatedEvent:
 		s.roomCreatedEventHandler(event)
+	case roomDeletedEvent:
+		s.roomDeletedEventHandler(event)
 	case userConnectedEvent:
 		s.userConnectedEventHandler(event)
 	case userDisconnectedEvent:
 		s.userDisconnectedEventHandler(event)
+	case userLoggedOutEvent:
+		s.userLoggedOutEventHandler(event)
+	case presenceEvent:
+		s.presenceEventHandler(event)
+	case presenceChangedEvent:
+		s.presenceChangedEventHandler(event)
+	case presenceHeartbeatEvent:
+		s.presenceHeartbeatEventHandler()
+	case shutdownEvent:
+		s.shutdownEventHandler(event)
 	default:
 		slog.Error("invalid event", "event", event)
 	}
 }
 
 func (service *Service) roomCreatedEventHandler(event roomCreatedEvent) {
+	service.roomsMu.Lock()
+	defer service.roomsMu.Unlock()
 	service.rooms[event.room.roomId] = event.room
 }
 
+func (service *Service) roomDeletedEventHandler(event roomDeletedEvent) {
+	service.roomsMu.Lock()
+	room, ok := service.rooms[event.roomId]
+	delete(service.rooms, event.roomId)
+	service.roomsMu.Unlock()
+	if !ok {
+		return
+	}
+	go room.push(roomClosedEvent{})
+}
+
 func (service *Service) userConnectedEventHandler(event userConnectedEvent) {
-	if user, ok := service.users[event.user.userId]; ok {
-		slog.Info(
-			"existing user connection found",
-			"userId", user.userId,
-			"address", fmt.Sprintf("%p", user),
-		)
-		user.disconnect()
+	before := service.presence(event.user.userId)
+	service.usersMu.Lock()
+	connections, ok := service.users[event.user.userId]
+	if !ok {
+		connections = make(map[*user]bool)
+		service.users[event.user.userId] = connections
+	}
+	connections[event.user] = true
+	count := len(connections)
+	service.usersMu.Unlock()
+	// connected after shutting down began, too late to be closed with the
+	// others
+	if service.stopping.Load() {
+		event.user.close(websocket.CloseServiceRestart, SHUTDOWN_REASON)
 	}
-	service.users[event.user.userId] = event.user
+	if event.user.clientId != "" {
+		for connection := range connections {
+			if connection != event.user &&
+				connection.sessionId == event.user.sessionId &&
+				connection.clientId == event.user.clientId {
+				connection.close(CLOSE_REPLACED, "connected again")
+			}
+		}
+	}
+	// only started once registered so that replay cannot miss live messages,
+	// and so that the disconnect always follows the connect
+	event.user.start()
 	slog.Info(
-		"connecting user",
+		"user connected",
 		"userId", event.user.userId,
 		"address", fmt.Sprintf("%p", event.user),
+		"connections", count,
 	)
-	if user, ok := service.users[event.user.userId]; ok {
-		slog.Info("user connected",
-			"userId", user.userId,
-			"address", fmt.Sprintf("%p", user),
-		)
-	}
+	service.presenceChanged(event.user, before)
 }
 
 func (service *Service) userDisconnectedEventHandler(
 	event userDisconnectedEvent,
 ) {
-	delete(service.users, event.userId)
+	connections, ok := service.users[event.user.userId]
+	if !ok || !connections[event.user] {
+		return
+	}
+	before := service.presence(event.user.userId)
+	service.usersMu.Lock()
+	delete(connections, event.user)
+	if len(connections) == 0 {
+		delete(service.users, event.user.userId)
+	}
+	service.usersMu.Unlock()
+	slog.Info(
+		"user disconnected",
+		"userId", event.user.userId,
+		"address", fmt.Sprintf("%p", event.user),
+		"connections", len(connections),
+		"code", event.user.closure.code,
+		"reason", event.user.closure.reason,
+	)
+	service.presenceChanged(event.user, before)
+}
+
+func (service *Service) shutdownEventHandler(event shutdownEvent) {
+	users := []*user{}
+	for _, connections := range service.users {
+		for connection := range connections {
+			connection.close(websocket.CloseServiceRestart, SHUTDOWN_REASON)
+			users = append(users, connection)
+		}
+	}
+	event.stopped <- users
+}
+
+// connections stay registered until their readPump stops
+func (service *Service) userLoggedOutEventHandler(event userLoggedOutEvent) {
+	for connection := range service.users[event.userId] {
+		if connection.sessionId == event.sessionId {
+			connection.close(CLOSE_LOGGED_OUT, "logged out")
+		}
+	}
+}
+
+func (service *Service) presenceChangedEventHandler(
+	event presenceChangedEvent,
+) {
+	if !service.users[event.user.userId][event.user] {
+		return
+	}
+	before := service.presence(event.user.userId)
+	event.user.presence = event.presence
+	service.presenceChanged(event.user, before)
+}
+
+// a user is online on this instance while any connection is, away while
+// connections exist but all of them are away, and offline once the last one
+// closes; the repository combines it with the other instances
+func (service *Service) presence(userId uuid.UUID) string {
+	connections, ok := service.users[userId]
+	if !ok {
+		return repository.PRESENCE_OFFLINE
+	}
+	for connection := range connections {
+		if connection.presence == repository.PRESENCE_ONLINE {
+			return repository.PRESENCE_ONLINE
+		}
+	}
+	return repository.PRESENCE_AWAY
+}
+
+func (service *Service) presenceChanged(user *user, before string) {
+	after := service.presence(user.userId)
+	if after == before {
+		return
+	}
+	service.presenceEventHandler(presenceEvent{
+		userId:   user.userId,
+		username: user.username,
+		presence: after,
+	})
+}
+
+// persists local presence changes, publishing them only when they change the
+// user's presence across instances, then tells every room so that rooms the
+// user belongs to can notify their members
+func (service *Service) presenceEventHandler(event presenceEvent) {
+	if !event.remote {
+		result, err := service.repository.UserPresenceUpdate(
+			context.Background(),
+			repository.UserPresenceUpdateParams{
+				UserId:     event.userId,
+				InstanceId: service.instanceId,
+				Presence:   event.presence,
+			},
+		)
+		switch {
+		case err != nil:
+			// the other instances are unknown, so the local presence is sent
+			slog.Error("error updating presence", "userId", event.userId)
+		case !result.Changed:
+			return
+		default:
+			event.presence = result.Presence
+		}
+		service.publish(broadcast{
+			Kind:     BROADCAST_PRESENCE,
+			UserId:   event.userId,
+			Name:     event.username,
+			Presence: event.presence,
+		})
+	}
+	for _, room := range service.allRooms() {
+		room.push(event)
+	}
+}
+
+func (service *Service) presenceHeartbeatEventHandler() {
+	if len(service.users) == 0 {
+		return
+	}
+	userIds := make([]uuid.UUID, 0, len(service.users))
+	for userId := range service.users {
+		userIds = append(userIds, userId)
+	}
+	err := service.repository.UsersLastSeenTouch(
+		context.Background(),
+		repository.UsersLastSeenTouchParams{
+			UserIds:    userIds,
+			InstanceId: service.instanceId,
+		},
+	)
+	if err != nil {
+		slog.Error("error touching last seen", "error", err.Error())
+	}
 }
@@ -0,0 +1,404 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gossip/internal/repository"
+	"gossip/internal/utils/ratelimit"
+	"math/rand"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	LOAD_USERS       = 8
+	LOAD_CONNECTIONS = 2
+	LOAD_ROOMS       = 4
+	LOAD_MESSAGES    = 50
+	LOAD_CHURN       = 100
+	// room for every frame the test produces, backpressure and rate limits
+	// are tested separately
+	LOAD_QUEUE_SIZE = 1 << 16
+)
+
+// meant to be run with -race: connections send into rooms while members
+// join and leave, rooms come and go and connections churn
+func TestServiceConcurrentLoad(t *testing.T) {
+	repository := newFakeRepository()
+	userIds := make([]uuid.UUID, LOAD_USERS)
+	for i := range userIds {
+		userIds[i] = uuid.Must(uuid.NewV4())
+	}
+	roomIds := make([]uuid.UUID, LOAD_ROOMS)
+	for i := range roomIds {
+		roomIds[i] = repository.addRoom(userIds...)
+	}
+	service, err := NewService(repository, fakeBroadcaster{}, Options{
+		SendQueueSize: LOAD_QUEUE_SIZE,
+		UserRate:      ratelimit.Params{Burst: LOAD_QUEUE_SIZE},
+		RoomRate:      ratelimit.Params{Burst: LOAD_QUEUE_SIZE},
+	})
+	if err != nil {
+		t.Fatal("failed to create service", err)
+	}
+	server := newTestServer(t, service)
+
+	var wg sync.WaitGroup
+	for _, userId := range userIds {
+		for i := 0; i < LOAD_CONNECTIONS; i++ {
+			conn, err := dial(server, userId)
+			if err != nil {
+				t.Fatal("failed to dial", err)
+			}
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				sendLoad(t, conn, roomIds)
+			}()
+			go func() {
+				defer wg.Done()
+				defer conn.Close()
+				awaitReplies(t, conn, LOAD_MESSAGES)
+			}()
+		}
+	}
+
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < LOAD_CHURN; i++ {
+			userId := userIds[rand.Intn(len(userIds))]
+			roomId := roomIds[rand.Intn(len(roomIds))]
+			service.UserLeaveRoom(userId, roomId)
+			service.UserJoinRoom(userId, roomId)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < LOAD_CHURN; i++ {
+			roomId := repository.addRoom(userIds...)
+			if err := service.RoomCreate(roomId); err != nil {
+				t.Error("failed to create room", err)
+				return
+			}
+			service.RoomRename(roomId, "renamed")
+			service.RoomDelete(roomId)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < LOAD_CHURN; i++ {
+			conn, err := dial(server, userIds[rand.Intn(len(userIds))])
+			if err != nil {
+				t.Error("failed to dial", err)
+				return
+			}
+			writeFrame(conn, FRAME_PRESENCE, "", presencePayload{Presence: "away"})
+			conn.Close()
+		}
+	}()
+
+	wg.Wait()
+}
+
+func sendLoad(t *testing.T, conn *websocket.Conn, roomIds []uuid.UUID) {
+	for i := 0; i < LOAD_MESSAGES; i++ {
+		roomId := roomIds[rand.Intn(len(roomIds))].String()
+		frames := []struct {
+			frameType string
+			id        string
+			payload   any
+		}{
+			{FRAME_ROOM_SUBSCRIBE, "", subscriptionPayload{RoomId: roomId}},
+			{FRAME_TYPING, "", typingPayload{RoomId: roomId, Typing: true}},
+			{FRAME_MESSAGE_SEND, fmt.Sprintf("m-%d", i), messageSendPayload{
+				RoomId: roomId,
+				Body:   "hello",
+			}},
+			{FRAME_PRESENCE, "", presencePayload{Presence: "online"}},
+		}
+		for _, frame := range frames {
+			err := writeFrame(conn, frame.frameType, frame.id, frame.payload)
+			if err != nil {
+				t.Error("failed to write frame", err)
+				return
+			}
+		}
+	}
+}
+
+// reads until every message sent on the connection was acked or refused
+func awaitReplies(t *testing.T, conn *websocket.Conn, count int) {
+	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	replies := make(map[string]bool)
+	for len(replies) < count {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Error("failed to read replies", len(replies), err)
+			return
+		}
+		var frame frame
+		if err := json.Unmarshal(data, &frame); err != nil {
+			t.Error("failed to decode frame", err)
+			return
+		}
+		if frame.Type != FRAME_ACK && frame.Type != FRAME_ERROR {
+			continue
+		}
+		if strings.HasPrefix(frame.Id, "m-") {
+			replies[frame.Id] = true
+		}
+	}
+}
+
+func TestServiceShutdown(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+	repository := newFakeRepository()
+	userId := uuid.Must(uuid.NewV4())
+	roomId := repository.addRoom(userId)
+	service, err := NewService(repository, fakeBroadcaster{}, Options{})
+	if err != nil {
+		t.Fatal("failed to create service", err)
+	}
+	server := newTestServer(t, service)
+	conn, err := dial(server, userId)
+	if err != nil {
+		t.Fatal("failed to dial", err)
+	}
+	defer conn.Close()
+	err = writeFrame(conn, FRAME_MESSAGE_SEND, "m-0", messageSendPayload{
+		RoomId: roomId.String(),
+		Body:   "hello",
+	})
+	if err != nil {
+		t.Fatal("failed to write frame", err)
+	}
+	awaitReplies(t, conn, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := service.Shutdown(ctx); err != nil {
+		t.Fatal("failed to shut down", err)
+	}
+	if code := awaitClose(t, conn); code != websocket.CloseServiceRestart {
+		t.Fatal("unexpected close code", code)
+	}
+	if _, err := dial(server, userId); err == nil {
+		t.Fatal("connected after shutting down")
+	}
+	server.Close()
+	awaitGoroutines(t, goroutines)
+}
+
+// frames that slip past their connection's check while shutting down are
+// refused by the room, or by the stopped room, rather than lost
+func TestLateSendsRefusedDuringShutdown(t *testing.T) {
+	repository := newFakeRepository()
+	userId := uuid.Must(uuid.NewV4())
+	roomId := repository.addRoom(userId)
+	service, err := NewService(repository, fakeBroadcaster{}, Options{})
+	if err != nil {
+		t.Fatal("failed to create service", err)
+	}
+	server := newTestServer(t, service)
+	conn, err := dial(server, userId)
+	if err != nil {
+		t.Fatal("failed to dial", err)
+	}
+	defer conn.Close()
+	err = writeFrame(conn, FRAME_MESSAGE_SEND, "m-0", messageSendPayload{
+		RoomId: roomId.String(),
+		Body:   "hello",
+	})
+	if err != nil {
+		t.Fatal("failed to write frame", err)
+	}
+	awaitReplies(t, conn, 1)
+	messageIds := repository.messageIds()
+
+	service.stopping.Store(true)
+	sender := service.connections(userId)[0]
+	event, err := newMessageEvent(sender, "m-late", messageSendPayload{
+		RoomId: roomId.String(),
+		Body:   "late",
+	})
+	if err != nil {
+		t.Fatal("failed to create event", err)
+	}
+	room, _ := service.room(roomId)
+	room.push(event)
+	if reply := awaitReply(t, conn, "m-late"); reply != ERROR_SHUTTING_DOWN {
+		t.Fatal("unexpected reply", reply)
+	}
+
+	service.cancel()
+	<-room.done
+	err = service.MessageEdit(userId, messageIds[0], "edited")
+	if !errors.Is(err, ShuttingDownError) {
+		t.Fatal("unexpected error", err)
+	}
+}
+
+// a user connected to two instances stays online when the connection to one
+// of them closes, and goes offline only once both have closed
+func TestPresenceAcrossInstances(t *testing.T) {
+	repo := newFakeRepository()
+	userId := uuid.Must(uuid.NewV4())
+	watcherId := uuid.Must(uuid.NewV4())
+	roomId := repo.addRoom(userId, watcherId)
+	bus := newFakeBus()
+	serviceA, err := NewService(repo, bus, Options{})
+	if err != nil {
+		t.Fatal("failed to create service", err)
+	}
+	serviceB, err := NewService(repo, bus, Options{})
+	if err != nil {
+		t.Fatal("failed to create service", err)
+	}
+	serverA := newTestServer(t, serviceA)
+	serverB := newTestServer(t, serviceB)
+
+	watcher, err := dial(serverA, watcherId)
+	if err != nil {
+		t.Fatal("failed to dial", err)
+	}
+	defer watcher.Close()
+	err = writeFrame(
+		watcher,
+		FRAME_ROOM_SUBSCRIBE,
+		"m-subscribe",
+		subscriptionPayload{RoomId: roomId.String()},
+	)
+	if err != nil {
+		t.Fatal("failed to write frame", err)
+	}
+	awaitReplies(t, watcher, 1)
+
+	connA, err := dial(serverA, userId)
+	if err != nil {
+		t.Fatal("failed to dial", err)
+	}
+	defer connA.Close()
+	connB, err := dial(serverB, userId)
+	if err != nil {
+		t.Fatal("failed to dial", err)
+	}
+	awaitConnections(t, serviceA, userId, 1)
+	awaitConnections(t, serviceB, userId, 1)
+
+	connB.Close()
+	awaitConnections(t, serviceB, userId, 0)
+	// handled in order, so the disconnect has been saved once this is taken
+	serviceB.push(presenceHeartbeatEvent{})
+	if presence := repo.presence(userId); presence != repository.PRESENCE_ONLINE {
+		t.Fatal("went offline with a connection left", presence)
+	}
+
+	connA.Close()
+	presences := []string{}
+	watcher.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for len(presences) == 0 || presences[len(presences)-1] != repository.PRESENCE_OFFLINE {
+		_, data, err := watcher.ReadMessage()
+		if err != nil {
+			t.Fatal("failed to read frame", presences, err)
+		}
+		var frame frame
+		if err := json.Unmarshal(data, &frame); err != nil {
+			t.Fatal("failed to decode frame", err)
+		}
+		if frame.Type != FRAME_PRESENCE {
+			continue
+		}
+		payload, _ := decodePayload[presencePayload](&frame)
+		if payload.UserId == userId.String() {
+			presences = append(presences, payload.Presence)
+		}
+	}
+	want := []string{repository.PRESENCE_ONLINE, repository.PRESENCE_OFFLINE}
+	if fmt.Sprint(presences) != fmt.Sprint(want) {
+		t.Fatal("unexpected presence frames", presences, want)
+	}
+}
+
+// after a gap in the broadcasts, rooms deliver the messages saved since the
+// last one they delivered and nothing earlier
+func TestResyncAfterLostBroadcasts(t *testing.T) {
+	repo := newFakeRepository()
+	userId := uuid.Must(uuid.NewV4())
+	roomId := repo.addRoom(userId)
+	bus := newFakeBus()
+	service, err := NewService(repo, bus, Options{})
+	if err != nil {
+		t.Fatal("failed to create service", err)
+	}
+	server := newTestServer(t, service)
+	conn, err := dial(server, userId)
+	if err != nil {
+		t.Fatal("failed to dial", err)
+	}
+	defer conn.Close()
+	err = writeFrame(
+		conn,
+		FRAME_ROOM_SUBSCRIBE,
+		"m-subscribe",
+		subscriptionPayload{RoomId: roomId.String()},
+	)
+	if err != nil {
+		t.Fatal("failed to write frame", err)
+	}
+	awaitReplies(t, conn, 1)
+	err = writeFrame(conn, FRAME_MESSAGE_SEND, "m-live", messageSendPayload{
+		RoomId: roomId.String(),
+		Body:   "delivered live",
+	})
+	if err != nil {
+		t.Fatal("failed to write frame", err)
+	}
+	if got := awaitReply(t, conn, "m-live"); got != FRAME_ACK {
+		t.Fatal("unexpected reply", got)
+	}
+
+	// saved by another instance whose broadcast never arrived
+	lost, err := repo.MessageSave(
+		context.Background(),
+		repository.MessageSaveParams{
+			UserId: userId,
+			RoomId: roomId,
+			Body:   "lost",
+		},
+	)
+	if err != nil {
+		t.Fatal("failed to save message", err)
+	}
+	if err := bus.Publish(context.Background(), []byte{}); err != nil {
+		t.Fatal("failed to publish", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal("failed to read frame", err)
+		}
+		var frame frame
+		if err := json.Unmarshal(data, &frame); err != nil {
+			t.Fatal("failed to decode frame", err)
+		}
+		if frame.Type != FRAME_MESSAGE_NEW {
+			continue
+		}
+		payload, _ := decodePayload[message](&frame)
+		if payload.MessageId != lost.MessageId.String() {
+			t.Fatal("resynced a message already delivered", payload.Body)
+		}
+		return
+	}
+}
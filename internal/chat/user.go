@@ -2,54 +2,126 @@ package chat
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"gossip/internal/repository"
+	"gossip/internal/utils/ratelimit"
 	"log/slog"
+	"net"
+	"sync"
+	"time"
 
 	"github.com/gofrs/uuid/v5"
 	"github.com/gorilla/websocket"
 )
 
 type user struct {
-	userId   uuid.UUID
-	username string
-	service  *Service
-	ingress  chan event
-	ctx      context.Context
-	cancel   context.CancelFunc
-	conn     *websocket.Conn
-	send     chan *message
-	alive    bool
+	userId    uuid.UUID
+	username  string
+	sessionId uuid.UUID
+	clientId  string
+	service   *Service
+	ingress   chan event
+	ctx       context.Context
+	cancel    context.CancelFunc
+	conn      *websocket.Conn
+	cursors   []Cursor
+	// why the connection ended, written once before ctx is cancelled
+	closeOnce sync.Once
+	closure   closure
+	// closed once writePump has said goodbye and closed the socket
+	stopped chan struct{}
+	// outbound frames, bounded so that rooms never wait on a slow socket;
+	// queued is signalled whenever frames are added
+	queueMu sync.Mutex
+	queue   []*frame
+	queued  chan struct{}
+	// only touched by the service goroutine
+	presence string
+	// rooms whose frames this connection receives, others only get activity
+	// notifications for new messages
+	subscriptionsMu sync.Mutex
+	subscriptions   map[uuid.UUID]bool
 }
 
+type closure struct {
+	code   int
+	reason string
+	// set when the socket is already unusable, in which case nothing queued
+	// is flushed and no close frame is sent
+	broken bool
+}
+
+// goroutines are only started once the service registered the user, see
+// userConnectedEventHandler
 func newUser(
 	service *Service,
 	conn *websocket.Conn,
-	userId uuid.UUID,
-	username string,
+	params UserConnectParams,
 ) *user {
 	ctx, cancel := context.WithCancel(context.Background())
+	// replayed rooms are subscribed from the start so nothing is missed
+	// between the replay and an explicit subscribe
+	subscriptions := make(map[uuid.UUID]bool)
+	for _, cursor := range params.Cursors {
+		subscriptions[cursor.RoomId] = true
+	}
 	user := &user{
-		userId:   userId,
-		username: username,
-		service:  service,
-		ingress:  make(chan event),
-		ctx:      ctx,
-		cancel:   cancel,
-		conn:     conn,
-		send:     make(chan *message),
-		alive:    true,
+		userId:    params.UserId,
+		username:  params.Username,
+		sessionId: params.SessionId,
+		clientId:  params.ClientId,
+		service:   service,
+		ingress:   make(chan event),
+		ctx:       ctx,
+		cancel:    cancel,
+		conn:      conn,
+		queued:    make(chan struct{}, 1),
+		stopped:   make(chan struct{}),
+		cursors:   params.Cursors,
+		presence:  repository.PRESENCE_ONLINE,
+
+		subscriptions: subscriptions,
 	}
 	user.conn.SetReadLimit(MAX_MESSAGE_SIZE)
+	// pongs and frames both prove the client is still there, a half-open
+	// socket stops sending either and its next read times out
+	user.conn.SetReadDeadline(time.Now().Add(service.options.PongWait))
+	user.conn.SetPongHandler(func(string) error {
+		return user.extendReadDeadline()
+	})
+	return user
+}
+
+func (user *user) start() {
 	go user.receiveEvents()
 	go user.readPump()
 	go user.writePump()
-	return user
+}
+
+// every way a connection ends goes through close or drop: the first call
+// records why and cancels ctx, which stops receiveEvents and has writePump
+// say goodbye and close the socket, which in turn stops readPump, the last
+// one out telling the service
+func (user *user) close(code int, reason string) {
+	user.end(closure{code: code, reason: reason})
+}
+
+// for sockets that already failed or were closed by the client
+func (user *user) drop(code int, reason string) {
+	user.end(closure{code: code, reason: reason, broken: true})
+}
+
+func (user *user) end(closure closure) {
+	user.closeOnce.Do(func() {
+		user.closure = closure
+		user.cancel()
+	})
 }
 
 func (user *user) readPump() {
 	defer func() {
-		user.alive = false
-		user.cancel()
-		user.conn.Close()
+		user.service.push(userDisconnectedEvent{user: user})
 		slog.Info("closing readPump")
 	}()
 	for {
@@ -57,65 +129,138 @@ func (user *user) readPump() {
 		case <-user.ctx.Done():
 			return
 		default:
-			var message message
-			if err := user.conn.ReadJSON(&message); err != nil {
-				slog.Error(
-					"error reading JSON",
-					"error",
-					err.Error(),
-					"message",
-					message,
-				)
+			_, data, err := user.conn.ReadMessage()
+			if err != nil {
+				user.readFailed(err)
 				return
 			}
-			slog.Info("readPump message", "message", message)
-			messageEvent, err := newMessageEvent(
-				user.userId,
-				user.username,
-				&message,
-			)
-			if err != nil {
-				slog.Error("error creating message event", "message", message)
-				continue
+			if err := user.extendReadDeadline(); err != nil {
+				user.drop(websocket.CloseAbnormalClosure, err.Error())
+				return
 			}
-			room, ok := user.service.rooms[messageEvent.roomId]
-			if !ok {
-				slog.Error("room not found", "message", message)
+			var frame frame
+			if err := json.Unmarshal(data, &frame); err != nil {
+				slog.Error("error decoding frame", "data", string(data))
+				user.sendError("", ERROR_INVALID_FRAME, "frame is not valid JSON")
 				continue
 			}
-			room.ingress <- messageEvent
+			slog.Info("readPump frame", "type", frame.Type, "id", frame.Id)
+			select {
+			case <-user.ctx.Done():
+				return
+			case user.ingress <- frameReceivedEvent{frame: &frame}:
+			}
 		}
 	}
 }
 
+func (user *user) readFailed(err error) {
+	var closeError *websocket.CloseError
+	if errors.As(err, &closeError) {
+		// the close frame was already answered by the default close handler
+		user.drop(closeError.Code, closeError.Text)
+		return
+	}
+	var netError net.Error
+	if errors.As(err, &netError) && netError.Timeout() {
+		user.close(CLOSE_IDLE, "no pong received")
+		return
+	}
+	slog.Error("error reading message", "error", err.Error())
+	user.drop(websocket.CloseAbnormalClosure, err.Error())
+}
+
+func (user *user) extendReadDeadline() error {
+	return user.conn.SetReadDeadline(
+		time.Now().Add(user.service.options.PongWait),
+	)
+}
+
+// the only goroutine closing the socket, which ends readPump
 func (user *user) writePump() {
+	ticker := time.NewTicker(user.service.options.PingPeriod)
 	defer func() {
+		ticker.Stop()
+		user.conn.Close()
+		close(user.stopped)
 		slog.Info("closing writePump")
 	}()
+	if err := user.replay(); err != nil {
+		slog.Error("error replaying messages", "error", err.Error())
+		user.drop(websocket.CloseAbnormalClosure, err.Error())
+		return
+	}
 	for {
 		select {
 		case <-user.ctx.Done():
+			user.goodbye()
 			return
-		case message, ok := <-user.send:
-			if !ok {
-				slog.Error("user send channel closed")
+		case <-ticker.C:
+			user.conn.SetWriteDeadline(
+				time.Now().Add(user.service.options.WriteWait),
+			)
+			err := user.conn.WriteMessage(websocket.PingMessage, nil)
+			if err != nil {
+				slog.Error("error writing ping", "error", err.Error())
+				user.drop(websocket.CloseAbnormalClosure, err.Error())
 				return
 			}
-			slog.Info("writePump message", "message", message)
-			if err := user.conn.WriteJSON(message); err != nil {
-				slog.Error(
-					"error writing JSON",
-					"error",
-					err.Error(),
-					"message",
-					message,
-				)
+		case <-user.queued:
+			if err := user.flush(); err != nil {
+				user.drop(websocket.CloseAbnormalClosure, err.Error())
 				return
 			}
 		}
 	}
 }
 
+func (user *user) flush() error {
+	for _, frame := range user.dequeue() {
+		slog.Info("writePump frame", "type", frame.Type, "id", frame.Id)
+		if err := user.write(frame); err != nil {
+			slog.Error(
+				"error writing JSON",
+				"error",
+				err.Error(),
+				"type",
+				frame.Type,
+			)
+			return err
+		}
+	}
+	return nil
+}
+
+// sends what is still queued, such as the frame explaining a kick, then the
+// close frame; ctx must be done so that closure is set
+func (user *user) goodbye() {
+	if user.closure.broken {
+		return
+	}
+	if err := user.flush(); err != nil {
+		return
+	}
+	user.conn.SetWriteDeadline(time.Now().Add(user.service.options.WriteWait))
+	user.conn.WriteMessage(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(user.closure.code, user.closure.reason),
+	)
+}
+
+// must only be called from writePump, connections allow a single writer
+func (user *user) write(frame *frame) error {
+	user.conn.SetWriteDeadline(time.Now().Add(user.service.options.WriteWait))
+	return user.conn.WriteJSON(frame)
+}
+
+func (user *user) dequeue() []*frame {
+	user.queueMu.Lock()
+	defer user.queueMu.Unlock()
+	frames := user.queue
+	user.queue = nil
+	return frames
+}
+
 func (user *user) receiveEvents() {
 	defer func() {
 		slog.Info("closing receiveEvents")
@@ -133,16 +278,397 @@ func (user *user) receiveEvents() {
 	}
 }
 
-func (user *user) disconnect() {
-	user.conn.WriteMessage(websocket.CloseMessage, nil)
-	slog.Info("close message written", "user", user)
+// a connection is alive until its context is cancelled
+func (user *user) alive() bool {
+	return user.ctx.Err() == nil
+}
+
+// never blocks, so rooms cannot hang on slow or dead users; a full queue is
+// handled by the service's overflow policy
+func (user *user) push(frame *frame) {
+	user.queueMu.Lock()
+	if !user.alive() {
+		user.queueMu.Unlock()
+		return
+	}
+	if len(user.queue) >= user.service.options.SendQueueSize &&
+		!user.makeRoom(frame) {
+		// closed under the lock so that concurrent pushes do not evict the
+		// connection twice, the queue is dropped as it is not worth sending
+		user.queue = nil
+		user.close(websocket.CloseTryAgainLater, "too slow to keep up")
+		user.queueMu.Unlock()
+		user.evict()
+		return
+	}
+	user.queue = append(user.queue, frame)
+	user.queueMu.Unlock()
+	select {
+	case user.queued <- struct{}{}:
+	default:
+	}
+}
+
+// frees a slot in the full queue, returning false when the connection has
+// to go instead; the queue lock must be held
+func (user *user) makeRoom(frame *frame) bool {
+	switch user.service.options.OverflowPolicy {
+	case OVERFLOW_DROP_OLDEST:
+		user.queue = user.queue[1:]
+		droppedFrames.Add(1)
+		return true
+	case OVERFLOW_COALESCE:
+		key, ok := coalesceKey(frame)
+		if !ok {
+			return false
+		}
+		for i, queued := range user.queue {
+			if queuedKey, ok := coalesceKey(queued); ok && queuedKey == key {
+				user.queue = append(user.queue[:i], user.queue[i+1:]...)
+				coalescedFrames.Add(1)
+				return true
+			}
+		}
+		return false
+	default:
+		return false
+	}
+}
+
+func (user *user) evict() {
+	evictedConnections.Add(1)
+	slog.Warn(
+		"evicting slow connection",
+		"userId", user.userId,
+		"policy", user.service.options.OverflowPolicy,
+	)
+}
+
+// pushes a room frame if the connection is subscribed to the room, otherwise
+// pushes the activity frame if there is one
+func (user *user) deliver(roomId uuid.UUID, frame *frame, activity *frame) {
+	if user.subscribed(roomId) {
+		user.push(frame)
+		return
+	}
+	if activity != nil {
+		user.push(activity)
+	}
+}
+
+func (user *user) subscribed(roomId uuid.UUID) bool {
+	user.subscriptionsMu.Lock()
+	defer user.subscriptionsMu.Unlock()
+	return user.subscriptions[roomId]
+}
+
+func (user *user) setSubscribed(roomId uuid.UUID, subscribed bool) {
+	user.subscriptionsMu.Lock()
+	defer user.subscriptionsMu.Unlock()
+	if subscribed {
+		user.subscriptions[roomId] = true
+	} else {
+		delete(user.subscriptions, roomId)
+	}
+}
+
+func (user *user) sendFrame(frameType string, id string, payload any) {
+	user.push(mustNewFrame(frameType, id, payload))
+}
+
+func (user *user) sendError(id string, code string, message string) {
+	user.sendFrame(FRAME_ERROR, id, errorPayload{
+		Code:    code,
+		Message: message,
+	})
+}
+
+// refuses the frame unless the limiter has a token for the key, telling the
+// client how long to wait
+func (user *user) allow(
+	id string,
+	limiter *ratelimit.Limiter,
+	key uuid.UUID,
+) bool {
+	result := limiter.Allow(key.String())
+	if result.Allowed {
+		return true
+	}
+	throttledFrames.Add(1)
+	payload := errorPayload{
+		Code:       ERROR_RATE_LIMITED,
+		Message:    "sending too fast, slow down",
+		RetryAfter: result.RetryAfter.Milliseconds(),
+	}
+	if result.Muted {
+		payload.Code = ERROR_MUTED
+		payload.Message = "muted for sending too fast"
+	}
+	user.sendFrame(FRAME_ERROR, id, payload)
+	return false
+}
+
+func (user *user) sendServiceError(id string, err error) {
+	code := errorCode(err)
+	if code == ERROR_INTERNAL {
+		slog.Error("internal error", "error", err.Error())
+		user.sendError(id, code, "internal error")
+		return
+	}
+	user.sendError(id, code, err.Error())
 }
 
 // event management
 
 func (user *user) eventHandler(event event) {
 	switch event := event.(type) {
+	case frameReceivedEvent:
+		user.frameReceivedEventHandler(event)
 	default:
 		slog.Error("invalid event", "event", event)
 	}
 }
+
+func (user *user) frameReceivedEventHandler(event frameReceivedEvent) {
+	frame := event.frame
+	if frame.Version != PROTOCOL_VERSION {
+		user.sendError(
+			frame.Id,
+			ERROR_UNSUPPORTED_VERSION,
+			"unsupported protocol version",
+		)
+		return
+	}
+	// clients resend anything unacked once reconnected elsewhere
+	if user.service.stopping.Load() {
+		user.sendServiceError(frame.Id, ShuttingDownError)
+		return
+	}
+	if !user.allow(frame.Id, user.service.userLimiter, user.userId) {
+		return
+	}
+	switch frame.Type {
+	case FRAME_MESSAGE_SEND:
+		user.messageSendFrameHandler(frame)
+	case FRAME_MESSAGE_EDIT:
+		user.messageEditFrameHandler(frame)
+	case FRAME_MESSAGE_DELETE:
+		user.messageDeleteFrameHandler(frame)
+	case FRAME_REACTION_ADD:
+		user.reactionFrameHandler(frame, true)
+	case FRAME_REACTION_REMOVE:
+		user.reactionFrameHandler(frame, false)
+	case FRAME_TYPING:
+		user.typingFrameHandler(frame)
+	case FRAME_READ:
+		user.readFrameHandler(frame)
+	case FRAME_PRESENCE:
+		user.presenceFrameHandler(frame)
+	case FRAME_ROOM_SUBSCRIBE:
+		user.subscriptionFrameHandler(frame, true)
+	case FRAME_ROOM_UNSUBSCRIBE:
+		user.subscriptionFrameHandler(frame, false)
+	default:
+		user.sendError(frame.Id, ERROR_UNKNOWN_TYPE, "unknown frame type")
+	}
+}
+
+// frame management
+
+func (user *user) messageSendFrameHandler(frame *frame) {
+	payload, err := decodePayload[messageSendPayload](frame)
+	if err != nil {
+		user.sendError(frame.Id, ERROR_INVALID_FRAME, "invalid payload")
+		return
+	}
+	if len(payload.ClientId) > MAX_CLIENT_ID_LENGTH {
+		user.sendError(frame.Id, ERROR_INVALID_FRAME, "client ID too long")
+		return
+	}
+	if payload.Body == "" {
+		user.sendServiceError(frame.Id, EmptyMessageError)
+		return
+	}
+	messageEvent, err := newMessageEvent(user, frame.Id, payload)
+	if err != nil {
+		user.sendError(frame.Id, ERROR_INVALID_FRAME, "invalid room or parent ID")
+		return
+	}
+	user.toRoom(frame.Id, messageEvent.roomId, messageEvent)
+}
+
+func (user *user) messageEditFrameHandler(frame *frame) {
+	payload, err := decodePayload[messageEditPayload](frame)
+	if err != nil {
+		user.sendError(frame.Id, ERROR_INVALID_FRAME, "invalid payload")
+		return
+	}
+	messageId, err := uuid.FromString(payload.MessageId)
+	if err != nil {
+		user.sendError(frame.Id, ERROR_INVALID_FRAME, "invalid message ID")
+		return
+	}
+	err = user.service.MessageEdit(user.userId, messageId, payload.Body)
+	if err != nil {
+		user.sendServiceError(frame.Id, err)
+		return
+	}
+	user.sendFrame(FRAME_ACK, frame.Id, nil)
+}
+
+func (user *user) messageDeleteFrameHandler(frame *frame) {
+	payload, err := decodePayload[messageDeletePayload](frame)
+	if err != nil {
+		user.sendError(frame.Id, ERROR_INVALID_FRAME, "invalid payload")
+		return
+	}
+	messageId, err := uuid.FromString(payload.MessageId)
+	if err != nil {
+		user.sendError(frame.Id, ERROR_INVALID_FRAME, "invalid message ID")
+		return
+	}
+	err = user.service.MessageDelete(user.userId, messageId)
+	if err != nil {
+		user.sendServiceError(frame.Id, err)
+		return
+	}
+	user.sendFrame(FRAME_ACK, frame.Id, nil)
+}
+
+func (user *user) reactionFrameHandler(frame *frame, added bool) {
+	payload, err := decodePayload[reactionPayload](frame)
+	if err != nil {
+		user.sendError(frame.Id, ERROR_INVALID_FRAME, "invalid payload")
+		return
+	}
+	if payload.Emoji == "" || len(payload.Emoji) > MAX_EMOJI_LENGTH {
+		user.sendError(frame.Id, ERROR_INVALID_FRAME, "invalid emoji")
+		return
+	}
+	roomId, err := uuid.FromString(payload.RoomId)
+	if err != nil {
+		user.sendError(frame.Id, ERROR_INVALID_FRAME, "invalid room ID")
+		return
+	}
+	messageId, err := uuid.FromString(payload.MessageId)
+	if err != nil {
+		user.sendError(frame.Id, ERROR_INVALID_FRAME, "invalid message ID")
+		return
+	}
+	user.toRoom(frame.Id, roomId, reactionEvent{
+		userId:    user.userId,
+		messageId: messageId,
+		emoji:     payload.Emoji,
+		added:     added,
+		sender:    user,
+		frameId:   frame.Id,
+	})
+}
+
+func (user *user) typingFrameHandler(frame *frame) {
+	payload, err := decodePayload[typingPayload](frame)
+	if err != nil {
+		user.sendError(frame.Id, ERROR_INVALID_FRAME, "invalid payload")
+		return
+	}
+	roomId, err := uuid.FromString(payload.RoomId)
+	if err != nil {
+		user.sendError(frame.Id, ERROR_INVALID_FRAME, "invalid room ID")
+		return
+	}
+	user.toRoom(frame.Id, roomId, typingEvent{
+		userId:   user.userId,
+		username: user.username,
+		typing:   payload.Typing,
+		sender:   user,
+		frameId:  frame.Id,
+	})
+}
+
+func (user *user) readFrameHandler(frame *frame) {
+	payload, err := decodePayload[readReceiptPayload](frame)
+	if err != nil {
+		user.sendError(frame.Id, ERROR_INVALID_FRAME, "invalid payload")
+		return
+	}
+	roomId, err := uuid.FromString(payload.RoomId)
+	if err != nil {
+		user.sendError(frame.Id, ERROR_INVALID_FRAME, "invalid room ID")
+		return
+	}
+	messageId, err := uuid.FromString(payload.MessageId)
+	if err != nil {
+		user.sendError(frame.Id, ERROR_INVALID_FRAME, "invalid message ID")
+		return
+	}
+	user.toRoom(frame.Id, roomId, readReceiptEvent{
+		userId:    user.userId,
+		messageId: messageId,
+		sender:    user,
+		frameId:   frame.Id,
+	})
+}
+
+func (user *user) subscriptionFrameHandler(frame *frame, subscribed bool) {
+	payload, err := decodePayload[subscriptionPayload](frame)
+	if err != nil {
+		user.sendError(frame.Id, ERROR_INVALID_FRAME, "invalid payload")
+		return
+	}
+	roomId, err := uuid.FromString(payload.RoomId)
+	if err != nil {
+		user.sendError(frame.Id, ERROR_INVALID_FRAME, "invalid room ID")
+		return
+	}
+	if subscribed {
+		isMember, err := user.service.repository.UserCheckRoomMembership(
+			context.Background(),
+			repository.UserCheckRoomMembershipParams{
+				UserId: user.userId,
+				RoomId: roomId,
+			},
+		)
+		if err != nil {
+			user.sendServiceError(frame.Id, err)
+			return
+		}
+		if !isMember {
+			user.sendError(frame.Id, ERROR_NOT_ROOM_MEMBER, NotRoomMemberError.Error())
+			return
+		}
+	}
+	user.setSubscribed(roomId, subscribed)
+	user.sendFrame(FRAME_ACK, frame.Id, nil)
+}
+
+// clients can only switch between online and away, offline follows the
+// socket closing
+func (user *user) presenceFrameHandler(frame *frame) {
+	payload, err := decodePayload[presencePayload](frame)
+	if err != nil {
+		user.sendError(frame.Id, ERROR_INVALID_FRAME, "invalid payload")
+		return
+	}
+	if payload.Presence != repository.PRESENCE_ONLINE &&
+		payload.Presence != repository.PRESENCE_AWAY {
+		user.sendError(frame.Id, ERROR_INVALID_FRAME, "invalid presence")
+		return
+	}
+	user.service.push(presenceChangedEvent{
+		user:     user,
+		presence: payload.Presence,
+	})
+	user.sendFrame(FRAME_ACK, frame.Id, nil)
+}
+
+func (user *user) toRoom(frameId string, roomId uuid.UUID, event event) {
+	room, ok := user.service.room(roomId)
+	if !ok {
+		slog.Error("room not found", "roomId", roomId)
+		user.sendError(frameId, ERROR_ROOM_NOT_FOUND, "room not found")
+		return
+	}
+	if !room.push(event) {
+		user.sendServiceError(frameId, user.service.roomStoppedError())
+	}
+}
@@ -0,0 +1,803 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gossip/internal/utils/ratelimit"
+	"net"
+	"net/http/httptest"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/gorilla/websocket"
+)
+
+// a server side connection whose writes can be made to hang, standing in for
+// a client that stopped reading, or to fail; hung writes fail once it is
+// closed, or go through once it is resumed
+type hangingConn struct {
+	net.Conn
+	hang       chan struct{}
+	hangOnce   sync.Once
+	hung       chan struct{}
+	hungOnce   sync.Once
+	resumed    chan struct{}
+	resumeOnce sync.Once
+	broken     chan struct{}
+	breakOnce  sync.Once
+	release    chan struct{}
+	closeOnce  sync.Once
+}
+
+func (conn *hangingConn) Write(data []byte) (int, error) {
+	select {
+	case <-conn.broken:
+		return 0, net.ErrClosed
+	case <-conn.hang:
+		conn.hungOnce.Do(func() { close(conn.hung) })
+		select {
+		case <-conn.release:
+			return 0, net.ErrClosed
+		case <-conn.resumed:
+			return conn.Conn.Write(data)
+		}
+	default:
+		return conn.Conn.Write(data)
+	}
+}
+
+func (conn *hangingConn) resume() {
+	conn.resumeOnce.Do(func() { close(conn.resumed) })
+}
+
+func (conn *hangingConn) fail() {
+	conn.breakOnce.Do(func() { close(conn.broken) })
+}
+
+func (conn *hangingConn) Close() error {
+	conn.closeOnce.Do(func() { close(conn.release) })
+	return conn.Conn.Close()
+}
+
+func (conn *hangingConn) stall() {
+	conn.hangOnce.Do(func() { close(conn.hang) })
+}
+
+type hangingListener struct {
+	net.Listener
+	accepted chan *hangingConn
+}
+
+func (listener *hangingListener) Accept() (net.Conn, error) {
+	conn, err := listener.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	hangingConn := &hangingConn{
+		Conn:    conn,
+		hang:    make(chan struct{}),
+		hung:    make(chan struct{}),
+		resumed: make(chan struct{}),
+		broken:  make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	listener.accepted <- hangingConn
+	return hangingConn, nil
+}
+
+func newHangingServer(
+	t *testing.T,
+	service *Service,
+) (*httptest.Server, *hangingListener) {
+	server := httptest.NewUnstartedServer(testHandler(t, service))
+	listener := &hangingListener{
+		Listener: server.Listener,
+		accepted: make(chan *hangingConn, 2),
+	}
+	server.Listener = listener
+	server.Start()
+	t.Cleanup(server.Close)
+	return server, listener
+}
+
+const HUNG_MESSAGES = 50
+
+func TestHungSocketDoesNotStallRoom(t *testing.T) {
+	policies := []struct {
+		policy  string
+		counter interface{ Value() int64 }
+	}{
+		{OVERFLOW_DROP_OLDEST, droppedFrames},
+		// new messages are never coalesced, see TestCoalesceKeepsLatestFrames
+		{OVERFLOW_COALESCE, evictedConnections},
+		{OVERFLOW_DISCONNECT, evictedConnections},
+	}
+	for _, policy := range policies {
+		policy := policy
+		t.Run(policy.policy, func(t *testing.T) {
+			repository := newFakeRepository()
+			hungUserId := uuid.Must(uuid.NewV4())
+			userId := uuid.Must(uuid.NewV4())
+			roomId := repository.addRoom(hungUserId, userId)
+			service, err := NewService(repository, fakeBroadcaster{}, Options{
+				SendQueueSize:  8,
+				OverflowPolicy: policy.policy,
+			})
+			if err != nil {
+				t.Fatal("failed to create service", err)
+			}
+			server, listener := newHangingServer(t, service)
+
+			hungConn, err := dial(server, hungUserId)
+			if err != nil {
+				t.Fatal("failed to dial", err)
+			}
+			defer hungConn.Close()
+			hung := <-listener.accepted
+			// subscribed so that it is sent every message, not just activity
+			err = writeFrame(
+				hungConn,
+				FRAME_ROOM_SUBSCRIBE,
+				"m-subscribe",
+				subscriptionPayload{RoomId: roomId.String()},
+			)
+			if err != nil {
+				t.Fatal("failed to write frame", err)
+			}
+			awaitReplies(t, hungConn, 1)
+			hung.stall()
+			defer hung.Close()
+
+			conn, err := dial(server, userId)
+			if err != nil {
+				t.Fatal("failed to dial", err)
+			}
+			defer conn.Close()
+			before := policy.counter.Value()
+			// every message is acked even though the hung member never reads
+			for i := 0; i < HUNG_MESSAGES; i++ {
+				err := writeFrame(
+					conn,
+					FRAME_MESSAGE_SEND,
+					fmt.Sprintf("m-%d", i),
+					messageSendPayload{RoomId: roomId.String(), Body: "hello"},
+				)
+				if err != nil {
+					t.Fatal("failed to write frame", err)
+				}
+				awaitReplies(t, conn, 1)
+			}
+			if policy.counter.Value() == before {
+				t.Fatal("overflow policy was not applied", policy.policy)
+			}
+		})
+	}
+}
+
+// a full queue drops the queued typing or read frame superseded by a new one
+// for the same room and user, keeping the connection open
+func TestCoalesceKeepsLatestFrames(t *testing.T) {
+	repository := newFakeRepository()
+	hungUserId := uuid.Must(uuid.NewV4())
+	userId := uuid.Must(uuid.NewV4())
+	roomId := repository.addRoom(hungUserId, userId)
+	service, err := NewService(repository, fakeBroadcaster{}, Options{
+		SendQueueSize:  2,
+		OverflowPolicy: OVERFLOW_COALESCE,
+	})
+	if err != nil {
+		t.Fatal("failed to create service", err)
+	}
+	server, listener := newHangingServer(t, service)
+	room, _ := service.room(roomId)
+	// waits for the service and then the room to handle everything before
+	barrier := func() {
+		service.push(presenceHeartbeatEvent{})
+		room.push(roomDrainedEvent{})
+	}
+
+	// connected first so that its presence is not queued on the hung socket
+	conn, err := dial(server, userId)
+	if err != nil {
+		t.Fatal("failed to dial", err)
+	}
+	defer conn.Close()
+	<-listener.accepted
+	awaitConnections(t, service, userId, 1)
+	barrier()
+
+	hungConn, err := dial(server, hungUserId)
+	if err != nil {
+		t.Fatal("failed to dial", err)
+	}
+	defer hungConn.Close()
+	hung := <-listener.accepted
+	defer hung.Close()
+	err = writeFrame(
+		hungConn,
+		FRAME_ROOM_SUBSCRIBE,
+		"m-subscribe",
+		subscriptionPayload{RoomId: roomId.String()},
+	)
+	if err != nil {
+		t.Fatal("failed to write frame", err)
+	}
+	awaitReplies(t, hungConn, 1)
+	hung.stall()
+
+	messageIds := make([]uuid.UUID, 4)
+	for i := range messageIds {
+		messageIds[i] = uuid.Must(uuid.NewV4())
+	}
+	read := func(i int) {
+		id := fmt.Sprintf("r-%d", i)
+		err := writeFrame(conn, FRAME_READ, id, readReceiptPayload{
+			RoomId:    roomId.String(),
+			MessageId: messageIds[i].String(),
+		})
+		if err != nil {
+			t.Fatal("failed to write frame", err)
+		}
+		if reply := awaitReply(t, conn, id); reply != FRAME_ACK {
+			t.Fatal("unexpected reply", reply)
+		}
+	}
+	// typing frames are not acked, the read after each one orders it
+	typing := func(typing bool) {
+		err := writeFrame(conn, FRAME_TYPING, "", typingPayload{
+			RoomId: roomId.String(),
+			Typing: typing,
+		})
+		if err != nil {
+			t.Fatal("failed to write frame", err)
+		}
+	}
+
+	// the first receipt is taken off the queue and hangs being written
+	read(0)
+	barrier()
+	<-hung.hung
+	before := coalescedFrames.Value()
+	read(1)
+	typing(true)
+	read(2)
+	typing(false)
+	read(3)
+	barrier()
+	if coalesced := coalescedFrames.Value() - before; coalesced != 3 {
+		t.Fatal("unexpected coalesced frames", coalesced)
+	}
+	connections := service.connections(hungUserId)
+	if len(connections) != 1 || !connections[0].alive() {
+		t.Fatal("coalescing connection was disconnected")
+	}
+
+	hung.resume()
+	reads := []string{}
+	typings := []bool{}
+	hungConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for len(reads) == 0 || reads[len(reads)-1] != messageIds[3].String() {
+		_, data, err := hungConn.ReadMessage()
+		if err != nil {
+			t.Fatal("failed to read frame", err)
+		}
+		var frame frame
+		if err := json.Unmarshal(data, &frame); err != nil {
+			t.Fatal("failed to decode frame", err)
+		}
+		switch frame.Type {
+		case FRAME_READ:
+			payload, _ := decodePayload[readReceiptPayload](&frame)
+			reads = append(reads, payload.MessageId)
+		case FRAME_TYPING:
+			payload, _ := decodePayload[typingPayload](&frame)
+			typings = append(typings, payload.Typing)
+		}
+	}
+	wantReads := []string{messageIds[0].String(), messageIds[3].String()}
+	if fmt.Sprint(reads) != fmt.Sprint(wantReads) {
+		t.Fatal("unexpected read frames", reads, wantReads)
+	}
+	if fmt.Sprint(typings) != fmt.Sprint([]bool{false}) {
+		t.Fatal("unexpected typing frames", typings)
+	}
+}
+
+func TestKeepaliveDisconnectsIdleSocket(t *testing.T) {
+	repository := newFakeRepository()
+	idleUserId := uuid.Must(uuid.NewV4())
+	userId := uuid.Must(uuid.NewV4())
+	service, err := NewService(repository, fakeBroadcaster{}, Options{
+		PongWait:   200 * time.Millisecond,
+		PingPeriod: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal("failed to create service", err)
+	}
+	server := newTestServer(t, service)
+
+	// never reads, so never answers pings either
+	idleConn, err := dial(server, idleUserId)
+	if err != nil {
+		t.Fatal("failed to dial", err)
+	}
+	defer idleConn.Close()
+	conn, err := dial(server, userId)
+	if err != nil {
+		t.Fatal("failed to dial", err)
+	}
+	defer conn.Close()
+	// reading answers pings with pongs
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(service.connections(idleUserId)) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("idle socket was never disconnected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if len(service.connections(userId)) != 1 {
+		t.Fatal("responsive socket was disconnected")
+	}
+}
+
+// sends are held to the same rule as edits
+func TestEmptyMessageRejected(t *testing.T) {
+	repository := newFakeRepository()
+	userId := uuid.Must(uuid.NewV4())
+	roomId := repository.addRoom(userId)
+	service, err := NewService(repository, fakeBroadcaster{}, Options{})
+	if err != nil {
+		t.Fatal("failed to create service", err)
+	}
+	server := newTestServer(t, service)
+	conn, err := dial(server, userId)
+	if err != nil {
+		t.Fatal("failed to dial", err)
+	}
+	defer conn.Close()
+	err = writeFrame(conn, FRAME_MESSAGE_SEND, "m-0", messageSendPayload{
+		RoomId: roomId.String(),
+	})
+	if err != nil {
+		t.Fatal("failed to write frame", err)
+	}
+	if reply := awaitReply(t, conn, "m-0"); reply != ERROR_INVALID_FRAME {
+		t.Fatal("unexpected reply", reply)
+	}
+}
+
+// a user over their limit is throttled, then muted for repeating it, while a
+// room over its limit throttles without muting
+func TestRateLimit(t *testing.T) {
+	repository := newFakeRepository()
+	userId := uuid.Must(uuid.NewV4())
+	otherUserId := uuid.Must(uuid.NewV4())
+	roomId := repository.addRoom(userId, otherUserId)
+	service, err := NewService(repository, fakeBroadcaster{}, Options{
+		UserRate: ratelimit.Params{
+			Interval:     time.Hour,
+			Burst:        2,
+			MuteAfter:    2,
+			MuteDuration: time.Hour,
+		},
+		RoomRate: ratelimit.Params{Interval: time.Hour, Burst: 3},
+	})
+	if err != nil {
+		t.Fatal("failed to create service", err)
+	}
+	server := newTestServer(t, service)
+	conn, err := dial(server, userId)
+	if err != nil {
+		t.Fatal("failed to dial", err)
+	}
+	defer conn.Close()
+	otherConn, err := dial(server, otherUserId)
+	if err != nil {
+		t.Fatal("failed to dial", err)
+	}
+	defer otherConn.Close()
+
+	send := func(conn *websocket.Conn, id string) string {
+		err := writeFrame(conn, FRAME_MESSAGE_SEND, id, messageSendPayload{
+			RoomId: roomId.String(),
+			Body:   "hello",
+		})
+		if err != nil {
+			t.Fatal("failed to write frame", err)
+		}
+		return awaitReply(t, conn, id)
+	}
+	for i, want := range []string{
+		FRAME_ACK,
+		FRAME_ACK,
+		ERROR_RATE_LIMITED,
+		ERROR_MUTED,
+		ERROR_MUTED,
+	} {
+		if got := send(conn, fmt.Sprintf("m-%d", i)); got != want {
+			t.Fatal("unexpected reply", i, got, want)
+		}
+	}
+	for i, want := range []string{FRAME_ACK, ERROR_RATE_LIMITED} {
+		if got := send(otherConn, fmt.Sprintf("o-%d", i)); got != want {
+			t.Fatal("unexpected reply", i, got, want)
+		}
+	}
+}
+
+// sends from outside a room are refused before they can spend its budget
+func TestRoomRateLimitIgnoresNonMembers(t *testing.T) {
+	repository := newFakeRepository()
+	memberId := uuid.Must(uuid.NewV4())
+	outsiderId := uuid.Must(uuid.NewV4())
+	roomId := repository.addRoom(memberId)
+	service, err := NewService(repository, fakeBroadcaster{}, Options{
+		RoomRate: ratelimit.Params{Interval: time.Hour, Burst: 2},
+	})
+	if err != nil {
+		t.Fatal("failed to create service", err)
+	}
+	server := newTestServer(t, service)
+	memberConn, err := dial(server, memberId)
+	if err != nil {
+		t.Fatal("failed to dial", err)
+	}
+	defer memberConn.Close()
+	outsiderConn, err := dial(server, outsiderId)
+	if err != nil {
+		t.Fatal("failed to dial", err)
+	}
+	defer outsiderConn.Close()
+
+	send := func(conn *websocket.Conn, id string) string {
+		err := writeFrame(conn, FRAME_MESSAGE_SEND, id, messageSendPayload{
+			RoomId: roomId.String(),
+			Body:   "hello",
+		})
+		if err != nil {
+			t.Fatal("failed to write frame", err)
+		}
+		return awaitReply(t, conn, id)
+	}
+	for i := 0; i < 5; i++ {
+		got := send(outsiderConn, fmt.Sprintf("o-%d", i))
+		if got != ERROR_NOT_ROOM_MEMBER {
+			t.Fatal("unexpected reply to outsider", i, got)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if got := send(memberConn, fmt.Sprintf("m-%d", i)); got != FRAME_ACK {
+			t.Fatal("member was throttled", i, got)
+		}
+	}
+}
+
+// a negative interval turns a limit off rather than falling back to the
+// default
+func TestRateLimitDisabled(t *testing.T) {
+	repository := newFakeRepository()
+	userId := uuid.Must(uuid.NewV4())
+	roomId := repository.addRoom(userId)
+	service, err := NewService(repository, fakeBroadcaster{}, Options{
+		UserRate: ratelimit.Params{Interval: -1, Burst: 1, MuteAfter: 1},
+		RoomRate: ratelimit.Params{Interval: -1, Burst: 1},
+	})
+	if err != nil {
+		t.Fatal("failed to create service", err)
+	}
+	server := newTestServer(t, service)
+	conn, err := dial(server, userId)
+	if err != nil {
+		t.Fatal("failed to dial", err)
+	}
+	defer conn.Close()
+
+	for i := 0; i < 5; i++ {
+		id := fmt.Sprintf("m-%d", i)
+		err := writeFrame(conn, FRAME_MESSAGE_SEND, id, messageSendPayload{
+			RoomId: roomId.String(),
+			Body:   "hello",
+		})
+		if err != nil {
+			t.Fatal("failed to write frame", err)
+		}
+		if got := awaitReply(t, conn, id); got != FRAME_ACK {
+			t.Fatal("limited with the limit off", i, got)
+		}
+	}
+}
+
+// connections not subscribed to a room hear about new messages in it,
+// unless the message is their own user's
+func TestActivitySkipsAuthor(t *testing.T) {
+	repository := newFakeRepository()
+	authorId := uuid.Must(uuid.NewV4())
+	otherUserId := uuid.Must(uuid.NewV4())
+	roomId := repository.addRoom(authorId, otherUserId)
+	otherRoomId := repository.addRoom(authorId, otherUserId)
+	service, err := NewService(repository, fakeBroadcaster{}, Options{})
+	if err != nil {
+		t.Fatal("failed to create service", err)
+	}
+	server := newTestServer(t, service)
+	subscribe := func(
+		userId uuid.UUID,
+		clientId string,
+		roomId uuid.UUID,
+	) *websocket.Conn {
+		conn, err := dialClient(server, userId, uuid.Nil, clientId)
+		if err != nil {
+			t.Fatal("failed to dial", err)
+		}
+		err = writeFrame(
+			conn,
+			FRAME_ROOM_SUBSCRIBE,
+			"m-subscribe",
+			subscriptionPayload{RoomId: roomId.String()},
+		)
+		if err != nil {
+			t.Fatal("failed to write frame", err)
+		}
+		awaitReplies(t, conn, 1)
+		return conn
+	}
+	send := func(conn *websocket.Conn, id string, roomId uuid.UUID) {
+		err := writeFrame(conn, FRAME_MESSAGE_SEND, id, messageSendPayload{
+			RoomId: roomId.String(),
+			Body:   "hello",
+		})
+		if err != nil {
+			t.Fatal("failed to write frame", err)
+		}
+		if got := awaitReply(t, conn, id); got != FRAME_ACK {
+			t.Fatal("unexpected reply", got)
+		}
+	}
+	authorConn := subscribe(authorId, "room", roomId)
+	defer authorConn.Close()
+	homeConn, err := dialClient(server, authorId, uuid.Nil, "home")
+	if err != nil {
+		t.Fatal("failed to dial", err)
+	}
+	defer homeConn.Close()
+	otherConn := subscribe(otherUserId, "room", otherRoomId)
+	defer otherConn.Close()
+
+	// activity is pushed before the ack, so any for the author's own message
+	// would be read before the other room's
+	send(authorConn, "m-own", roomId)
+	send(otherConn, "m-other", otherRoomId)
+	homeConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, data, err := homeConn.ReadMessage()
+		if err != nil {
+			t.Fatal("failed to read frame", err)
+		}
+		var frame frame
+		if err := json.Unmarshal(data, &frame); err != nil {
+			t.Fatal("failed to decode frame", err)
+		}
+		if frame.Type != FRAME_ROOM_ACTIVITY {
+			continue
+		}
+		payload, _ := decodePayload[subscriptionPayload](&frame)
+		if payload.RoomId != otherRoomId.String() {
+			t.Fatal("activity for the author's own message", payload.RoomId)
+		}
+		return
+	}
+}
+
+// reads until the frame with the ID is acked or refused, returning the ack
+// type or the error code
+func awaitReply(t *testing.T, conn *websocket.Conn, id string) string {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal("failed to read reply", err)
+		}
+		var frame frame
+		if err := json.Unmarshal(data, &frame); err != nil {
+			t.Fatal("failed to decode frame", err)
+		}
+		if frame.Id != id {
+			continue
+		}
+		switch frame.Type {
+		case FRAME_ACK:
+			return FRAME_ACK
+		case FRAME_ERROR:
+			payload, err := decodePayload[errorPayload](&frame)
+			if err != nil {
+				t.Fatal("failed to decode error", err)
+			}
+			return payload.Code
+		}
+	}
+}
+
+// each way a connection can end closes it with its own code, removes it from
+// the service and stops its goroutines
+func TestDisconnectLifecycle(t *testing.T) {
+	cases := []struct {
+		name string
+		// ends the connection, returning the close code expected by the
+		// client or 0 when the client does not get to read one
+		disconnect func(t *testing.T, env *lifecycleEnv) int
+	}{
+		{"client close", func(t *testing.T, env *lifecycleEnv) int {
+			env.conn.WriteMessage(
+				websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+			)
+			// the echoed close frame surfaces as ErrCloseSent on this side
+			return 0
+		}},
+		{"read error", func(t *testing.T, env *lifecycleEnv) int {
+			env.conn.NetConn().Close()
+			return 0
+		}},
+		{"write error", func(t *testing.T, env *lifecycleEnv) int {
+			env.serverConn.fail()
+			writeFrame(env.conn, FRAME_PRESENCE, "", presencePayload{
+				Presence: "away",
+			})
+			return 0
+		}},
+		{"logout", func(t *testing.T, env *lifecycleEnv) int {
+			env.service.UserLogout(env.userId, env.sessionId)
+			return CLOSE_LOGGED_OUT
+		}},
+		{"kick", func(t *testing.T, env *lifecycleEnv) int {
+			env.service.UserKick(env.userId, env.roomId)
+			return CLOSE_KICKED
+		}},
+		{"duplicate login", func(t *testing.T, env *lifecycleEnv) int {
+			conn, err := dialClient(
+				env.server,
+				env.userId,
+				env.sessionId,
+				env.clientId,
+			)
+			if err != nil {
+				t.Fatal("failed to dial", err)
+			}
+			env.replacement = conn
+			return CLOSE_REPLACED
+		}},
+	}
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			env := newLifecycleEnv(t)
+			code := c.disconnect(t, env)
+			closeCode := awaitClose(t, env.conn)
+			if code != 0 && closeCode != code {
+				t.Fatal("unexpected close code", closeCode, "expected", code)
+			}
+			if env.replacement != nil {
+				awaitConnections(t, env.service, env.userId, 1)
+				env.replacement.Close()
+			}
+			awaitConnections(t, env.service, env.userId, 0)
+			awaitGoroutines(t, env.goroutines)
+		})
+	}
+}
+
+type lifecycleEnv struct {
+	service     *Service
+	server      *httptest.Server
+	userId      uuid.UUID
+	sessionId   uuid.UUID
+	clientId    string
+	roomId      uuid.UUID
+	conn        *websocket.Conn
+	serverConn  *hangingConn
+	replacement *websocket.Conn
+	goroutines  int
+}
+
+// a single connection subscribed to a room, with the goroutine count from
+// before it connected
+func newLifecycleEnv(t *testing.T) *lifecycleEnv {
+	repository := newFakeRepository()
+	env := &lifecycleEnv{
+		userId:    uuid.Must(uuid.NewV4()),
+		sessionId: uuid.Must(uuid.NewV4()),
+		clientId:  "client",
+	}
+	env.roomId = repository.addRoom(env.userId)
+	service, err := NewService(repository, fakeBroadcaster{}, Options{})
+	if err != nil {
+		t.Fatal("failed to create service", err)
+	}
+	env.service = service
+	server, listener := newHangingServer(t, service)
+	env.server = server
+	env.goroutines = runtime.NumGoroutine()
+	conn, err := dialClient(server, env.userId, env.sessionId, env.clientId)
+	if err != nil {
+		t.Fatal("failed to dial", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	env.conn = conn
+	env.serverConn = <-listener.accepted
+	err = writeFrame(
+		conn,
+		FRAME_ROOM_SUBSCRIBE,
+		"m-subscribe",
+		subscriptionPayload{RoomId: env.roomId.String()},
+	)
+	if err != nil {
+		t.Fatal("failed to write frame", err)
+	}
+	awaitReplies(t, conn, 1)
+	return env
+}
+
+// reads until the connection closes, returning the close code received if
+// any
+func awaitClose(t *testing.T, conn *websocket.Conn) int {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, _, err := conn.ReadMessage()
+		if err == nil {
+			continue
+		}
+		var closeError *websocket.CloseError
+		if errors.As(err, &closeError) {
+			return closeError.Code
+		}
+		var netError net.Error
+		if errors.As(err, &netError) && netError.Timeout() {
+			t.Fatal("connection was never closed")
+		}
+		return 0
+	}
+}
+
+func awaitConnections(t *testing.T, service *Service, userId uuid.UUID, count int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for len(service.connections(userId)) != count {
+		if time.Now().After(deadline) {
+			t.Fatal(
+				"unexpected connections",
+				len(service.connections(userId)),
+				"expected", count,
+			)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// the connection goroutines take a moment to notice they are done
+func awaitGoroutines(t *testing.T, count int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > count {
+		if time.Now().After(deadline) {
+			buffer := make([]byte, 1<<20)
+			buffer = buffer[:runtime.Stack(buffer, true)]
+			t.Fatalf(
+				"leaked %d goroutines\n%s",
+				runtime.NumGoroutine()-count,
+				buffer,
+			)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
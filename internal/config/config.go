@@ -4,13 +4,38 @@ import (
 	"fmt"
 	"os"
 	"reflect"
+	"strconv"
+	"time"
 )
 
+// optional fields are left at their zero value when unset, leaving the
+// default to whatever consumes them; a negative rate interval turns that
+// limit off
 type config struct {
-	PostgresURL   string `env:"POSTGRES_URL"`
-	ServerAddress string `env:"SERVER_ADDRESS"`
+	PostgresURL          string        `env:"POSTGRES_URL"`
+	ServerAddress        string        `env:"SERVER_ADDRESS"`
+	ChatSendQueueSize    int           `env:"CHAT_SEND_QUEUE_SIZE" optional:"true"`
+	ChatOverflowPolicy   string        `env:"CHAT_OVERFLOW_POLICY" optional:"true"`
+	ChatWriteWait        time.Duration `env:"CHAT_WRITE_WAIT" optional:"true"`
+	ChatPongWait         time.Duration `env:"CHAT_PONG_WAIT" optional:"true"`
+	ChatPingPeriod       time.Duration `env:"CHAT_PING_PERIOD" optional:"true"`
+	ChatUserRateInterval time.Duration `env:"CHAT_USER_RATE_INTERVAL" optional:"true"`
+	ChatUserBurst        int           `env:"CHAT_USER_RATE_BURST" optional:"true"`
+	ChatRoomRateInterval time.Duration `env:"CHAT_ROOM_RATE_INTERVAL" optional:"true"`
+	ChatRoomBurst        int           `env:"CHAT_ROOM_RATE_BURST" optional:"true"`
+	ChatMuteAfter        int           `env:"CHAT_MUTE_AFTER" optional:"true"`
+	ChatMuteDuration     time.Duration `env:"CHAT_MUTE_DURATION" optional:"true"`
+	AuthRateInterval     time.Duration `env:"AUTH_RATE_INTERVAL" optional:"true"`
+	AuthBurst            int           `env:"AUTH_RATE_BURST" optional:"true"`
+	AuthMuteAfter        int           `env:"AUTH_MUTE_AFTER" optional:"true"`
+	AuthMuteDuration     time.Duration `env:"AUTH_MUTE_DURATION" optional:"true"`
+	ClientIPHeader       string        `env:"CLIENT_IP_HEADER" optional:"true"`
+	ShutdownTimeout      time.Duration `env:"SHUTDOWN_TIMEOUT" optional:"true"`
+	DebugAddress         string        `env:"DEBUG_ADDRESS" optional:"true"`
 }
 
+var durationType = reflect.TypeOf(time.Duration(0))
+
 func Init() (config, error) {
 	var env config
 	queryStructType := reflect.TypeOf(env)
@@ -19,9 +44,28 @@ func Init() (config, error) {
 		key := field.Tag.Get("env")
 		value := os.Getenv(key)
 		if value == "" {
+			if field.Tag.Get("optional") == "true" {
+				continue
+			}
 			return env, missingConfigError(key)
 		}
-		queryStructValue.FieldByIndex(field.Index).SetString(value)
+		fieldValue := queryStructValue.FieldByIndex(field.Index)
+		switch {
+		case field.Type == durationType:
+			duration, err := time.ParseDuration(value)
+			if err != nil {
+				return env, invalidConfigError(key)
+			}
+			fieldValue.SetInt(int64(duration))
+		case field.Type.Kind() == reflect.Int:
+			number, err := strconv.Atoi(value)
+			if err != nil {
+				return env, invalidConfigError(key)
+			}
+			fieldValue.SetInt(int64(number))
+		default:
+			fieldValue.SetString(value)
+		}
 	}
 	return env, nil
 }
@@ -29,3 +73,7 @@ func Init() (config, error) {
 func missingConfigError(key string) error {
 	return fmt.Errorf("missing environment variable: %s", key)
 }
+
+func invalidConfigError(key string) error {
+	return fmt.Errorf("invalid environment variable: %s", key)
+}
@@ -3,3 +3,43 @@ package repository
 import "time"
 
 const SESSION_DURATION = time.Hour * 24
+
+// presence not refreshed within this window is reported as offline, so
+// users of a crashed instance do not stay online forever
+const PRESENCE_STALE_AFTER = time.Minute * 3
+
+const (
+	ROOM_KIND_GROUP  = "group"
+	ROOM_KIND_DIRECT = "direct"
+)
+
+const (
+	ROOM_ROLE_OWNER  = "owner"
+	ROOM_ROLE_ADMIN  = "admin"
+	ROOM_ROLE_MEMBER = "member"
+)
+
+const (
+	ROOM_VISIBILITY_PUBLIC  = "public"
+	ROOM_VISIBILITY_INVITE  = "invite"
+	ROOM_VISIBILITY_REQUEST = "request"
+)
+
+const (
+	ROOM_JOIN_STATUS_JOINED    = "joined"
+	ROOM_JOIN_STATUS_REQUESTED = "requested"
+	ROOM_JOIN_STATUS_MEMBER    = "member"
+)
+
+// private use characters that ts_headline wraps search matches in, taken out
+// of message bodies beforehand so that only the matches carry them
+const (
+	HEADLINE_START = "\uE000"
+	HEADLINE_STOP  = "\uE001"
+)
+
+const (
+	PRESENCE_ONLINE  = "online"
+	PRESENCE_AWAY    = "away"
+	PRESENCE_OFFLINE = "offline"
+)
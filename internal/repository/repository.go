@@ -2,6 +2,10 @@ package repository
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"html"
+	"strings"
 	"time"
 
 	"github.com/gofrs/uuid/v5"
@@ -9,6 +13,11 @@ import (
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
+var (
+	InvalidInviteError  = errors.New("invite is invalid or expired")
+	InviteRequiredError = errors.New("room requires an invite")
+)
+
 type Repository struct {
 	PgPool *pgxpool.Pool
 }
@@ -116,13 +125,38 @@ func (r *Repository) UserFindOneByUsername(
 	)
 }
 
+// a user's presence across every instance refreshed within the stale window:
+// online when any instance is, away when any is, offline when there are none.
+// expects users in scope, the stale window as $2, offline as $3 and online as
+// $4
+const userPresenceSelect = `
+	COALESCE(
+		(
+			SELECT
+				user_instance_presences.presence
+			FROM user_instance_presences
+			WHERE
+				1 = 1
+				AND user_instance_presences.user_id = users.id
+				AND user_instance_presences.seen_at >= CURRENT_TIMESTAMP - $2::interval
+			ORDER BY
+				user_instance_presences.presence = $4 DESC
+			LIMIT 1
+		),
+		$3
+	)
+`
+
 type UsersFindManyByRoomIdParams struct {
 	RoomId uuid.UUID
 }
 
 type UsersFindManyByRoomIdResult struct {
-	UserId   uuid.UUID `db:"id" json:"userId"`
-	Username string    `db:"username" json:"username"`
+	UserId     uuid.UUID  `db:"id" json:"userId"`
+	Username   string     `db:"username" json:"username"`
+	Role       string     `db:"role" json:"role"`
+	Presence   string     `db:"presence" json:"presence"`
+	LastSeenAt *time.Time `db:"last_seen_at" json:"lastSeenAt"`
 }
 
 func (r *Repository) UsersFindManyByRoomId(
@@ -132,14 +166,26 @@ func (r *Repository) UsersFindManyByRoomId(
 	sql := `
 	SELECT
 		users.id,
-		users.username
+		users.username,
+		room_users.role,
+		` + userPresenceSelect + ` AS presence,
+		users.last_seen_at
 	FROM room_users
 		INNER JOIN users ON users.id = room_users.user_id
 	WHERE
 		room_users.room_id = $1
+	ORDER BY
+		users.username
 	;
 	`
-	rows, err := r.PgPool.Query(ctx, sql, dto.RoomId)
+	rows, err := r.PgPool.Query(
+		ctx,
+		sql,
+		dto.RoomId,
+		PRESENCE_STALE_AFTER,
+		PRESENCE_OFFLINE,
+		PRESENCE_ONLINE,
+	)
 	defer rows.Close()
 	if err != nil {
 		return nil, err
@@ -150,6 +196,147 @@ func (r *Repository) UsersFindManyByRoomId(
 	)
 }
 
+// the presence of the user's connections on one instance, offline once the
+// instance has none left
+type UserPresenceUpdateParams struct {
+	UserId     uuid.UUID
+	InstanceId uuid.UUID
+	Presence   string
+}
+
+type UserPresenceUpdateResult struct {
+	Presence string
+	// whether the presence across instances differs from the one last saved
+	Changed bool
+}
+
+// records the instance's presence for the user and saves the user's presence
+// across every instance; the user is locked so that instances updating at
+// once agree on which of them changed it
+func (r *Repository) UserPresenceUpdate(
+	ctx context.Context,
+	dto UserPresenceUpdateParams,
+) (UserPresenceUpdateResult, error) {
+	tx, err := r.PgPool.Begin(ctx)
+	if err != nil {
+		return UserPresenceUpdateResult{}, err
+	}
+	defer tx.Rollback(ctx)
+	sql := `
+	SELECT
+		presence
+	FROM users
+	WHERE
+		id = $1
+	FOR UPDATE
+	;
+	`
+	rows, err := tx.Query(ctx, sql, dto.UserId)
+	if err != nil {
+		return UserPresenceUpdateResult{}, err
+	}
+	before, err := pgx.CollectExactlyOneRow(rows, pgx.RowTo[string])
+	if err != nil {
+		return UserPresenceUpdateResult{}, err
+	}
+	if dto.Presence == PRESENCE_OFFLINE {
+		sql = `
+		DELETE FROM user_instance_presences
+		WHERE
+			1 = 1
+			AND user_id = $1
+			AND instance_id = $2
+		;
+		`
+		_, err = tx.Exec(ctx, sql, dto.UserId, dto.InstanceId)
+	} else {
+		sql = `
+		INSERT INTO user_instance_presences (
+			user_id,
+			instance_id,
+			presence
+		)
+		VALUES (
+			$1,
+			$2,
+			$3
+		)
+		ON CONFLICT (user_id, instance_id) DO UPDATE
+		SET
+			presence = EXCLUDED.presence,
+			seen_at = CURRENT_TIMESTAMP
+		;
+		`
+		_, err = tx.Exec(ctx, sql, dto.UserId, dto.InstanceId, dto.Presence)
+	}
+	if err != nil {
+		return UserPresenceUpdateResult{}, err
+	}
+	sql = `
+	UPDATE users
+	SET
+		presence = ` + userPresenceSelect + `,
+		last_seen_at = CURRENT_TIMESTAMP
+	WHERE
+		id = $1
+	RETURNING
+		presence
+	;
+	`
+	rows, err = tx.Query(
+		ctx,
+		sql,
+		dto.UserId,
+		PRESENCE_STALE_AFTER,
+		PRESENCE_OFFLINE,
+		PRESENCE_ONLINE,
+	)
+	if err != nil {
+		return UserPresenceUpdateResult{}, err
+	}
+	after, err := pgx.CollectExactlyOneRow(rows, pgx.RowTo[string])
+	if err != nil {
+		return UserPresenceUpdateResult{}, err
+	}
+	result := UserPresenceUpdateResult{
+		Presence: after,
+		Changed:  after != before,
+	}
+	return result, tx.Commit(ctx)
+}
+
+type UsersLastSeenTouchParams struct {
+	UserIds    []uuid.UUID
+	InstanceId uuid.UUID
+}
+
+// keeps connected users, and the instance's presence for them, from going
+// stale without changing their presence
+func (r *Repository) UsersLastSeenTouch(
+	ctx context.Context,
+	dto UsersLastSeenTouchParams,
+) error {
+	sql := `
+	WITH touched AS (
+		UPDATE user_instance_presences
+		SET
+			seen_at = CURRENT_TIMESTAMP
+		WHERE
+			1 = 1
+			AND user_id = ANY($1)
+			AND instance_id = $2
+	)
+	UPDATE users
+	SET
+		last_seen_at = CURRENT_TIMESTAMP
+	WHERE
+		id = ANY($1)
+	;
+	`
+	_, err := r.PgPool.Exec(ctx, sql, dto.UserIds, dto.InstanceId)
+	return err
+}
+
 type UserUpdateParams struct {
 	UserId       uuid.UUID
 	Username     *string
@@ -237,47 +424,362 @@ func (r *Repository) UserCheckRoomMembership(
 type UserJoinRoomParams struct {
 	UserId uuid.UUID
 	RoomId uuid.UUID
+	// when set, the invite decides the room and RoomId is ignored
+	InviteId *uuid.UUID
+}
+
+type UserJoinRoomResult struct {
+	RoomId uuid.UUID
+	Status string
 }
 
+// joins a group room according to its visibility: public rooms are joined
+// directly, request rooms queue a join request, and invite rooms can only be
+// joined by redeeming a valid invite
 func (r *Repository) UserJoinRoom(
 	ctx context.Context,
 	dto UserJoinRoomParams,
-) error {
+) (UserJoinRoomResult, error) {
+	tx, err := r.PgPool.Begin(ctx)
+	if err != nil {
+		return UserJoinRoomResult{}, err
+	}
+	defer tx.Rollback(ctx)
+	result := UserJoinRoomResult{RoomId: dto.RoomId}
+	if dto.InviteId != nil {
+		sql := `
+		UPDATE room_invites
+		SET
+			uses = uses + 1
+		WHERE
+			1 = 1
+			AND id = $1
+			AND (expires_on IS NULL OR expires_on > CURRENT_TIMESTAMP)
+			AND (max_uses IS NULL OR uses < max_uses)
+		RETURNING
+			room_id
+		;
+		`
+		rows, err := tx.Query(ctx, sql, dto.InviteId)
+		if err != nil {
+			return UserJoinRoomResult{}, err
+		}
+		result.RoomId, err = pgx.CollectExactlyOneRow(rows, pgx.RowTo[uuid.UUID])
+		if errors.Is(err, pgx.ErrNoRows) {
+			return UserJoinRoomResult{}, InvalidInviteError
+		}
+		if err != nil {
+			return UserJoinRoomResult{}, err
+		}
+	} else {
+		sql := `
+		SELECT
+			visibility
+		FROM rooms
+		WHERE
+			1 = 1
+			AND id = $1
+			AND kind = $2
+		FOR SHARE
+		;
+		`
+		rows, err := tx.Query(ctx, sql, dto.RoomId, ROOM_KIND_GROUP)
+		if err != nil {
+			return UserJoinRoomResult{}, err
+		}
+		visibility, err := pgx.CollectExactlyOneRow(rows, pgx.RowTo[string])
+		if err != nil {
+			return UserJoinRoomResult{}, err
+		}
+		switch visibility {
+		case ROOM_VISIBILITY_INVITE:
+			return UserJoinRoomResult{}, InviteRequiredError
+		case ROOM_VISIBILITY_REQUEST:
+			sql := `
+			INSERT INTO room_join_requests (
+				room_id,
+				user_id
+			)
+			SELECT
+				$1,
+				$2
+			WHERE NOT EXISTS (
+				SELECT 1
+				FROM room_users
+				WHERE
+					1 = 1
+					AND room_id = $1
+					AND user_id = $2
+			)
+			ON CONFLICT DO NOTHING
+			;
+			`
+			if _, err := tx.Exec(ctx, sql, dto.RoomId, dto.UserId); err != nil {
+				return UserJoinRoomResult{}, err
+			}
+			result.Status = ROOM_JOIN_STATUS_REQUESTED
+			return result, tx.Commit(ctx)
+		}
+	}
 	sql := `
 	INSERT INTO room_users (
 		user_id,
-		room_id
+		room_id,
+		role
 	)
 	VALUES (
 		$1,
-		$2
+		$2,
+		$3
 	)
+	ON CONFLICT DO NOTHING
+	;
+	`
+	tag, err := tx.Exec(ctx, sql, dto.UserId, result.RoomId, ROOM_ROLE_MEMBER)
+	if err != nil {
+		return UserJoinRoomResult{}, err
+	}
+	if tag.RowsAffected() == 0 {
+		// already a member, rolled back so that an invite is not spent
+		result.Status = ROOM_JOIN_STATUS_MEMBER
+		return result, tx.Rollback(ctx)
+	}
+	// a request queued before joining some other way is no longer pending
+	sql = `
+	DELETE FROM room_join_requests
+	WHERE
+		1 = 1
+		AND room_id = $1
+		AND user_id = $2
+	;
+	`
+	if _, err := tx.Exec(ctx, sql, result.RoomId, dto.UserId); err != nil {
+		return UserJoinRoomResult{}, err
+	}
+	result.Status = ROOM_JOIN_STATUS_JOINED
+	return result, tx.Commit(ctx)
+}
+
+type RoomUserRoleFindOneParams struct {
+	UserId uuid.UUID
+	RoomId uuid.UUID
+}
+
+type RoomUserRoleFindOneResult struct {
+	Role string `db:"role" json:"role"`
+}
+
+// returns pgx.ErrNoRows when the user is not a member of the room
+func (r *Repository) RoomUserRoleFindOne(
+	ctx context.Context,
+	dto RoomUserRoleFindOneParams,
+) (RoomUserRoleFindOneResult, error) {
+	sql := `
+	SELECT
+		role
+	FROM room_users
+	WHERE
+		1 = 1
+		AND user_id = $1
+		AND room_id = $2
 	;
 	`
 	rows, err := r.PgPool.Query(ctx, sql, dto.UserId, dto.RoomId)
 	defer rows.Close()
+	if err != nil {
+		return RoomUserRoleFindOneResult{}, err
+	}
+	return pgx.CollectExactlyOneRow(
+		rows,
+		pgx.RowToStructByName[RoomUserRoleFindOneResult],
+	)
+}
+
+type RoomUserRoleUpdateParams struct {
+	UserId uuid.UUID
+	RoomId uuid.UUID
+	Role   string
+}
+
+func (r *Repository) RoomUserRoleUpdate(
+	ctx context.Context,
+	dto RoomUserRoleUpdateParams,
+) error {
+	sql := `
+	UPDATE room_users
+	SET
+		role = $1
+	WHERE
+		1 = 1
+		AND user_id = $2
+		AND room_id = $3
+	;
+	`
+	rows, err := r.PgPool.Query(ctx, sql, dto.Role, dto.UserId, dto.RoomId)
+	defer rows.Close()
 	return err
 }
 
+type RoomReadUpdateParams struct {
+	UserId    uuid.UUID
+	RoomId    uuid.UUID
+	MessageId uuid.UUID
+}
+
+// only ever moves the read marker forward, returning false when the message
+// is not newer than the current marker or not in the room
+func (r *Repository) RoomReadUpdate(
+	ctx context.Context,
+	dto RoomReadUpdateParams,
+) (bool, error) {
+	sql := `
+	UPDATE room_users
+	SET
+		last_read_message_id = messages.id
+	FROM messages
+		LEFT JOIN messages AS last_read ON last_read.id = (
+			SELECT last_read_message_id
+			FROM room_users
+			WHERE
+				1 = 1
+				AND user_id = $1
+				AND room_id = $2
+		)
+	WHERE
+		1 = 1
+		AND room_users.user_id = $1
+		AND room_users.room_id = $2
+		AND messages.id = $3
+		AND messages.room_id = $2
+		AND (
+			last_read.id IS NULL
+			OR (messages.timestamp, messages.id) > (last_read.timestamp, last_read.id)
+		)
+	RETURNING
+		room_users.user_id
+	;
+	`
+	rows, err := r.PgPool.Query(ctx, sql, dto.UserId, dto.RoomId, dto.MessageId)
+	defer rows.Close()
+	if err != nil {
+		return false, err
+	}
+	ids, err := pgx.CollectRows(rows, pgx.RowTo[uuid.UUID])
+	return len(ids) > 0, err
+}
+
+type MessageSeenByFindManyParams struct {
+	MessageId uuid.UUID
+}
+
+type MessageSeenByFindManyResult struct {
+	UserId   uuid.UUID `db:"id" json:"userId"`
+	Username string    `db:"username" json:"username"`
+}
+
+// members other than the author whose read marker is at or past the message
+func (r *Repository) MessageSeenByFindMany(
+	ctx context.Context,
+	dto MessageSeenByFindManyParams,
+) ([]MessageSeenByFindManyResult, error) {
+	sql := `
+	SELECT
+		users.id,
+		users.username
+	FROM messages
+		INNER JOIN room_users ON room_users.room_id = messages.room_id
+		INNER JOIN messages AS last_read
+			ON last_read.id = room_users.last_read_message_id
+		INNER JOIN users ON users.id = room_users.user_id
+	WHERE
+		1 = 1
+		AND messages.id = $1
+		AND room_users.user_id <> messages.user_id
+		AND (last_read.timestamp, last_read.id) >= (messages.timestamp, messages.id)
+	ORDER BY
+		users.username
+	;
+	`
+	rows, err := r.PgPool.Query(ctx, sql, dto.MessageId)
+	defer rows.Close()
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(
+		rows,
+		pgx.RowToStructByName[MessageSeenByFindManyResult],
+	)
+}
+
 type UserLeaveRoomParams struct {
 	UserId uuid.UUID
 	RoomId uuid.UUID
 }
 
+// an owner leaving hands the room to an admin, failing that to the member
+// who posted first, so that the room is never left without an owner while
+// it has members
 func (r *Repository) UserLeaveRoom(
 	ctx context.Context,
 	dto UserLeaveRoomParams,
 ) error {
 	sql := `
-	DELETE FROM room_users
+	WITH left_member AS (
+		DELETE FROM room_users
+		WHERE
+			1 = 1
+			AND user_id = $1
+			AND room_id = $2
+		RETURNING
+			role
+	),
+	successor AS (
+		SELECT
+			user_id
+		FROM room_users
+		WHERE
+			1 = 1
+			AND room_id = $2
+			AND user_id <> $1
+			AND EXISTS (
+				SELECT
+					1
+				FROM left_member
+				WHERE
+					left_member.role = $3
+			)
+		ORDER BY
+			role = $4 DESC,
+			(
+				SELECT
+					MIN(timestamp)
+				FROM messages
+				WHERE
+					1 = 1
+					AND messages.room_id = room_users.room_id
+					AND messages.user_id = room_users.user_id
+			) ASC NULLS LAST,
+			user_id ASC
+		LIMIT 1
+	)
+	UPDATE room_users
+	SET
+		role = $3
+	FROM successor
 	WHERE
 		1 = 1
-		AND user_id = $1
-		AND room_id = $2
+		AND room_users.room_id = $2
+		AND room_users.user_id = successor.user_id
 	;
 	`
-	rows, err := r.PgPool.Query(ctx, sql, dto.UserId, dto.RoomId)
-	defer rows.Close()
+	_, err := r.PgPool.Exec(
+		ctx,
+		sql,
+		dto.UserId,
+		dto.RoomId,
+		ROOM_ROLE_OWNER,
+		ROOM_ROLE_ADMIN,
+	)
 	return err
 }
 
@@ -378,37 +880,72 @@ func (r *Repository) SessionDelete(
 }
 
 type RoomCreateParams struct {
-	Name string
+	Name       string
+	Visibility string
+	OwnerId    uuid.UUID
 }
 
 type RoomCreateResult struct {
 	RoomId uuid.UUID `db:"id" json:"roomId"`
 }
 
+// creates a group room with its creator as the owner
 func (r *Repository) RoomCreate(
 	ctx context.Context,
 	dto RoomCreateParams,
 ) (RoomCreateResult, error) {
+	tx, err := r.PgPool.Begin(ctx)
+	if err != nil {
+		return RoomCreateResult{}, err
+	}
+	defer tx.Rollback(ctx)
 	sql := `
 	INSERT INTO rooms (
-		name
+		name,
+		visibility
 	)
 	VALUES (
-		$1
+		$1,
+		$2
 	)
 	RETURNING
 		id
 	;
 	`
-	rows, err := r.PgPool.Query(ctx, sql, dto.Name)
-	defer rows.Close()
+	rows, err := tx.Query(ctx, sql, dto.Name, dto.Visibility)
 	if err != nil {
 		return RoomCreateResult{}, err
 	}
-	return pgx.CollectExactlyOneRow(
+	result, err := pgx.CollectExactlyOneRow(
 		rows,
 		pgx.RowToStructByName[RoomCreateResult],
 	)
+	if err != nil {
+		return RoomCreateResult{}, err
+	}
+	sql = `
+	INSERT INTO room_users (
+		user_id,
+		room_id,
+		role
+	)
+	VALUES (
+		$1,
+		$2,
+		$3
+	)
+	;
+	`
+	if _, err := tx.Exec(
+		ctx,
+		sql,
+		dto.OwnerId,
+		result.RoomId,
+		ROOM_ROLE_OWNER,
+	); err != nil {
+		return RoomCreateResult{}, err
+	}
+	return result, tx.Commit(ctx)
 }
 
 type RoomFindOneParams struct {
@@ -416,7 +953,9 @@ type RoomFindOneParams struct {
 }
 
 type RoomFindOneResult struct {
-	Name string `db:"name" json:"name"`
+	Name       string `db:"name" json:"name"`
+	Kind       string `db:"kind" json:"kind"`
+	Visibility string `db:"visibility" json:"visibility"`
 }
 
 func (r *Repository) RoomFindOne(
@@ -425,7 +964,9 @@ func (r *Repository) RoomFindOne(
 ) (RoomFindOneResult, error) {
 	sql := `
 	SELECT
-		name
+		name,
+		kind,
+		visibility
 	FROM rooms
 	WHERE
 		id = $1
@@ -465,13 +1006,96 @@ func (r *Repository) RoomFindMany(
 	return pgx.CollectRows(rows, pgx.RowToStructByName[RoomFindManyResult])
 }
 
+type RoomDirectoryFindManyParams struct {
+	UserId uuid.UUID
+	// matches a name prefix or the words of the name
+	Query string
+	// name of the last room on the previous page
+	After *string
+	Limit int
+}
+
+type RoomDirectoryFindManyResult struct {
+	RoomId       uuid.UUID  `db:"id" json:"roomId"`
+	Name         string     `db:"name" json:"name"`
+	Visibility   string     `db:"visibility" json:"visibility"`
+	MemberCount  int        `db:"member_count" json:"memberCount"`
+	LastActivity *time.Time `db:"last_activity" json:"lastActivity"`
+	IsMember     bool       `db:"is_member" json:"isMember"`
+}
+
+// lists discoverable group rooms by name; invite only rooms are never listed
+func (r *Repository) RoomDirectoryFindMany(
+	ctx context.Context,
+	dto RoomDirectoryFindManyParams,
+) ([]RoomDirectoryFindManyResult, error) {
+	sql := `
+	SELECT
+		rooms.id,
+		rooms.name,
+		rooms.visibility,
+		(
+			SELECT COUNT(*)
+			FROM room_users
+			WHERE room_users.room_id = rooms.id
+		) AS member_count,
+		(
+			SELECT MAX(messages.timestamp)
+			FROM messages
+			WHERE messages.room_id = rooms.id
+		) AS last_activity,
+		EXISTS (
+			SELECT 1
+			FROM room_users
+			WHERE
+				1 = 1
+				AND room_users.room_id = rooms.id
+				AND room_users.user_id = $1
+		) AS is_member
+	FROM rooms
+	WHERE
+		1 = 1
+		AND rooms.kind = $2
+		AND rooms.visibility = ANY($3)
+		AND (
+			$4::text = ''
+			OR starts_with(lower(rooms.name), lower($4))
+			OR to_tsvector('simple', rooms.name) @@ websearch_to_tsquery('simple', $4)
+		)
+		AND ($5::text IS NULL OR rooms.name > $5)
+	ORDER BY
+		rooms.name
+	LIMIT $6
+	;
+	`
+	rows, err := r.PgPool.Query(
+		ctx,
+		sql,
+		dto.UserId,
+		ROOM_KIND_GROUP,
+		[]string{ROOM_VISIBILITY_PUBLIC, ROOM_VISIBILITY_REQUEST},
+		dto.Query,
+		dto.After,
+		dto.Limit,
+	)
+	defer rows.Close()
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(
+		rows,
+		pgx.RowToStructByName[RoomDirectoryFindManyResult],
+	)
+}
+
 type RoomFindManyByUserIdParams struct {
 	UserId uuid.UUID
 }
 
 type RoomFindManyByUserIdResult struct {
-	RoomId uuid.UUID `db:"id" json:"roomId"`
-	Name   string    `db:"name" json:"name"`
+	RoomId      uuid.UUID `db:"id" json:"roomId"`
+	Name        string    `db:"name" json:"name"`
+	UnreadCount int       `db:"unread_count" json:"unreadCount"`
 }
 
 func (r *Repository) RoomFindManyByUserId(
@@ -481,14 +1105,31 @@ func (r *Repository) RoomFindManyByUserId(
 	sql := `
 	SELECT
 		rooms.id,
-		rooms.name
+		rooms.name,
+		(
+			SELECT COUNT(*)
+			FROM messages
+				LEFT JOIN messages AS last_read
+					ON last_read.id = room_users.last_read_message_id
+			WHERE
+				1 = 1
+				AND messages.room_id = room_users.room_id
+				AND messages.user_id <> room_users.user_id
+				AND messages.deleted_at IS NULL
+				AND (
+					last_read.id IS NULL
+					OR (messages.timestamp, messages.id) > (last_read.timestamp, last_read.id)
+				)
+		) AS unread_count
 	FROM room_users
 		INNER JOIN rooms ON rooms.id = room_users.room_id
 	WHERE
-		room_users.user_id = $1
+		1 = 1
+		AND room_users.user_id = $1
+		AND rooms.kind = $2
 	;
 	`
-	rows, err := r.PgPool.Query(ctx, sql, dto.UserId)
+	rows, err := r.PgPool.Query(ctx, sql, dto.UserId, ROOM_KIND_GROUP)
 	defer rows.Close()
 	if err != nil {
 		return nil, err
@@ -499,24 +1140,161 @@ func (r *Repository) RoomFindManyByUserId(
 	)
 }
 
-type RoomUpdateParams struct {
-	RoomId uuid.UUID
-	Name   *string
+type DirectRoomOpenParams struct {
+	UserId      uuid.UUID
+	OtherUserId uuid.UUID
 }
 
-func (r *Repository) RoomUpdate(
+type DirectRoomOpenResult struct {
+	RoomId  uuid.UUID `db:"id" json:"roomId"`
+	Created bool      `db:"created" json:"created"`
+}
+
+// direct rooms are keyed by their ordered member IDs, so opening a direct
+// room between the same two users always returns the same room
+func (r *Repository) DirectRoomOpen(
 	ctx context.Context,
-	dto RoomUpdateParams,
-) error {
+	dto DirectRoomOpenParams,
+) (DirectRoomOpenResult, error) {
+	first, second := dto.UserId.String(), dto.OtherUserId.String()
+	if second < first {
+		first, second = second, first
+	}
+	tx, err := r.PgPool.Begin(ctx)
+	if err != nil {
+		return DirectRoomOpenResult{}, err
+	}
+	defer tx.Rollback(ctx)
 	sql := `
-	UPDATE rooms
+	INSERT INTO rooms (
+		kind,
+		name
+	)
+	VALUES (
+		$1,
+		$2
+	)
+	ON CONFLICT (kind, name) DO UPDATE
 	SET
-		name = COALESCE($1, name)
+		name = EXCLUDED.name
+	RETURNING
+		id,
+		xmax::text = '0' AS created
+	;
+	`
+	rows, err := tx.Query(ctx, sql, ROOM_KIND_DIRECT, first+":"+second)
+	if err != nil {
+		return DirectRoomOpenResult{}, err
+	}
+	result, err := pgx.CollectExactlyOneRow(
+		rows,
+		pgx.RowToStructByName[DirectRoomOpenResult],
+	)
+	if err != nil {
+		return DirectRoomOpenResult{}, err
+	}
+	sql = `
+	INSERT INTO room_users (
+		room_id,
+		user_id
+	)
+	VALUES
+		($1, $2),
+		($1, $3)
+	ON CONFLICT DO NOTHING
+	;
+	`
+	if _, err := tx.Exec(
+		ctx,
+		sql,
+		result.RoomId,
+		dto.UserId,
+		dto.OtherUserId,
+	); err != nil {
+		return DirectRoomOpenResult{}, err
+	}
+	return result, tx.Commit(ctx)
+}
+
+type DirectRoomsFindManyByUserIdParams struct {
+	UserId uuid.UUID
+}
+
+type DirectRoomsFindManyByUserIdResult struct {
+	RoomId        uuid.UUID `db:"id" json:"roomId"`
+	OtherUserId   uuid.UUID `db:"other_user_id" json:"otherUserId"`
+	OtherUsername string    `db:"other_username" json:"otherUsername"`
+	UnreadCount   int       `db:"unread_count" json:"unreadCount"`
+}
+
+func (r *Repository) DirectRoomsFindManyByUserId(
+	ctx context.Context,
+	dto DirectRoomsFindManyByUserIdParams,
+) ([]DirectRoomsFindManyByUserIdResult, error) {
+	sql := `
+	SELECT
+		rooms.id,
+		others.user_id AS other_user_id,
+		users.username AS other_username,
+		(
+			SELECT COUNT(*)
+			FROM messages
+				LEFT JOIN messages AS last_read
+					ON last_read.id = room_users.last_read_message_id
+			WHERE
+				1 = 1
+				AND messages.room_id = room_users.room_id
+				AND messages.user_id <> room_users.user_id
+				AND messages.deleted_at IS NULL
+				AND (
+					last_read.id IS NULL
+					OR (messages.timestamp, messages.id) > (last_read.timestamp, last_read.id)
+				)
+		) AS unread_count
+	FROM room_users
+		INNER JOIN rooms ON rooms.id = room_users.room_id
+		INNER JOIN room_users AS others ON others.room_id = rooms.id
+		INNER JOIN users ON users.id = others.user_id
 	WHERE
-		id = $2
+		1 = 1
+		AND room_users.user_id = $1
+		AND others.user_id <> $1
+		AND rooms.kind = $2
+	ORDER BY
+		users.username ASC
 	;
 	`
-	rows, err := r.PgPool.Query(ctx, sql, dto.Name, dto.RoomId)
+	rows, err := r.PgPool.Query(ctx, sql, dto.UserId, ROOM_KIND_DIRECT)
+	defer rows.Close()
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(
+		rows,
+		pgx.RowToStructByName[DirectRoomsFindManyByUserIdResult],
+	)
+}
+
+type RoomUpdateParams struct {
+	RoomId     uuid.UUID
+	Name       *string
+	Visibility *string
+}
+
+func (r *Repository) RoomUpdate(
+	ctx context.Context,
+	dto RoomUpdateParams,
+) error {
+	sql := `
+	UPDATE rooms
+	SET
+		name = COALESCE($1, name),
+		visibility = COALESCE($2, visibility)
+	WHERE
+		id = $3
+	;
+	`
+	rows, err := r.PgPool.Query(ctx, sql, dto.Name, dto.Visibility, dto.RoomId)
 	defer rows.Close()
 	return err
 }
@@ -540,74 +1318,859 @@ func (r *Repository) RoomDelete(
 	return err
 }
 
-type MessageSaveParams struct {
+type RoomInviteCreateParams struct {
+	RoomId    uuid.UUID
+	CreatedBy uuid.UUID
+	ExpiresOn *time.Time
+	MaxUses   *int
+}
+
+type RoomInvite struct {
+	InviteId  uuid.UUID  `db:"id" json:"inviteId"`
+	ExpiresOn *time.Time `db:"expires_on" json:"expiresOn"`
+	MaxUses   *int       `db:"max_uses" json:"maxUses"`
+	Uses      int        `db:"uses" json:"uses"`
+}
+
+func (r *Repository) RoomInviteCreate(
+	ctx context.Context,
+	dto RoomInviteCreateParams,
+) (RoomInvite, error) {
+	sql := `
+	INSERT INTO room_invites (
+		room_id,
+		created_by,
+		expires_on,
+		max_uses
+	)
+	VALUES (
+		$1,
+		$2,
+		$3,
+		$4
+	)
+	RETURNING
+		id,
+		expires_on,
+		max_uses,
+		uses
+	;
+	`
+	rows, err := r.PgPool.Query(
+		ctx,
+		sql,
+		dto.RoomId,
+		dto.CreatedBy,
+		dto.ExpiresOn,
+		dto.MaxUses,
+	)
+	defer rows.Close()
+	if err != nil {
+		return RoomInvite{}, err
+	}
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[RoomInvite])
+}
+
+type RoomInvitesFindManyByRoomIdParams struct {
+	RoomId uuid.UUID
+}
+
+// only returns invites that can still be redeemed
+func (r *Repository) RoomInvitesFindManyByRoomId(
+	ctx context.Context,
+	dto RoomInvitesFindManyByRoomIdParams,
+) ([]RoomInvite, error) {
+	sql := `
+	SELECT
+		id,
+		expires_on,
+		max_uses,
+		uses
+	FROM room_invites
+	WHERE
+		1 = 1
+		AND room_id = $1
+		AND (expires_on IS NULL OR expires_on > CURRENT_TIMESTAMP)
+		AND (max_uses IS NULL OR uses < max_uses)
+	ORDER BY
+		created_at DESC
+	;
+	`
+	rows, err := r.PgPool.Query(ctx, sql, dto.RoomId)
+	defer rows.Close()
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[RoomInvite])
+}
+
+type RoomInviteDeleteParams struct {
+	InviteId uuid.UUID
+	RoomId   uuid.UUID
+}
+
+func (r *Repository) RoomInviteDelete(
+	ctx context.Context,
+	dto RoomInviteDeleteParams,
+) (bool, error) {
+	sql := `
+	DELETE FROM room_invites
+	WHERE
+		1 = 1
+		AND id = $1
+		AND room_id = $2
+	RETURNING
+		id
+	;
+	`
+	rows, err := r.PgPool.Query(ctx, sql, dto.InviteId, dto.RoomId)
+	defer rows.Close()
+	if err != nil {
+		return false, err
+	}
+	ids, err := pgx.CollectRows(rows, pgx.RowTo[uuid.UUID])
+	return len(ids) > 0, err
+}
+
+type RoomJoinRequestsFindManyByRoomIdParams struct {
+	RoomId uuid.UUID
+}
+
+type RoomJoinRequestsFindManyByRoomIdResult struct {
+	UserId    uuid.UUID `db:"user_id" json:"userId"`
+	Username  string    `db:"username" json:"username"`
+	CreatedAt time.Time `db:"created_at" json:"createdAt"`
+}
+
+func (r *Repository) RoomJoinRequestsFindManyByRoomId(
+	ctx context.Context,
+	dto RoomJoinRequestsFindManyByRoomIdParams,
+) ([]RoomJoinRequestsFindManyByRoomIdResult, error) {
+	sql := `
+	SELECT
+		room_join_requests.user_id,
+		users.username,
+		room_join_requests.created_at
+	FROM room_join_requests
+	JOIN users ON room_join_requests.user_id = users.id
+	WHERE
+		1 = 1
+		AND room_join_requests.room_id = $1
+		AND NOT EXISTS (
+			SELECT 1
+			FROM room_users
+			WHERE
+				1 = 1
+				AND room_users.room_id = room_join_requests.room_id
+				AND room_users.user_id = room_join_requests.user_id
+		)
+	ORDER BY
+		room_join_requests.created_at
+	;
+	`
+	rows, err := r.PgPool.Query(ctx, sql, dto.RoomId)
+	defer rows.Close()
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(
+		rows,
+		pgx.RowToStructByName[RoomJoinRequestsFindManyByRoomIdResult],
+	)
+}
+
+type RoomJoinRequestApproveParams struct {
 	UserId uuid.UUID
 	RoomId uuid.UUID
-	Body   string
 }
 
+// turns a pending join request into a membership, returning false when there
+// was no pending request
+func (r *Repository) RoomJoinRequestApprove(
+	ctx context.Context,
+	dto RoomJoinRequestApproveParams,
+) (bool, error) {
+	tx, err := r.PgPool.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+	sql := `
+	DELETE FROM room_join_requests
+	WHERE
+		1 = 1
+		AND user_id = $1
+		AND room_id = $2
+	;
+	`
+	tag, err := tx.Exec(ctx, sql, dto.UserId, dto.RoomId)
+	if err != nil {
+		return false, err
+	}
+	if tag.RowsAffected() == 0 {
+		return false, nil
+	}
+	sql = `
+	INSERT INTO room_users (
+		user_id,
+		room_id,
+		role
+	)
+	VALUES (
+		$1,
+		$2,
+		$3
+	)
+	ON CONFLICT DO NOTHING
+	;
+	`
+	if _, err := tx.Exec(
+		ctx,
+		sql,
+		dto.UserId,
+		dto.RoomId,
+		ROOM_ROLE_MEMBER,
+	); err != nil {
+		return false, err
+	}
+	return true, tx.Commit(ctx)
+}
+
+type RoomJoinRequestDeleteParams struct {
+	UserId uuid.UUID
+	RoomId uuid.UUID
+}
+
+func (r *Repository) RoomJoinRequestDelete(
+	ctx context.Context,
+	dto RoomJoinRequestDeleteParams,
+) (bool, error) {
+	sql := `
+	DELETE FROM room_join_requests
+	WHERE
+		1 = 1
+		AND user_id = $1
+		AND room_id = $2
+	RETURNING
+		user_id
+	;
+	`
+	rows, err := r.PgPool.Query(ctx, sql, dto.UserId, dto.RoomId)
+	defer rows.Close()
+	if err != nil {
+		return false, err
+	}
+	ids, err := pgx.CollectRows(rows, pgx.RowTo[uuid.UUID])
+	return len(ids) > 0, err
+}
+
+type MessageSaveParams struct {
+	UserId   uuid.UUID
+	RoomId   uuid.UUID
+	Body     string
+	ClientId *string
+	ParentId *uuid.UUID
+}
+
+type MessageSaveResult struct {
+	MessageId uuid.UUID  `db:"id" json:"messageId"`
+	Timestamp time.Time  `db:"timestamp" json:"timestamp"`
+	ParentId  *uuid.UUID `db:"parent_id" json:"parentId"`
+	Duplicate bool       `db:"duplicate" json:"duplicate"`
+}
+
+// saving with a client ID the user has already used in the room returns the
+// message saved the first time instead of inserting a new one; xmax is only non-zero
+// for rows touched by the conflict update, which marks them as duplicates.
+// replies to a reply are attached to the root of its thread, and nothing is
+// saved when the parent is not in the same room, returning pgx.ErrNoRows
 func (r *Repository) MessageSave(
 	ctx context.Context,
 	dto MessageSaveParams,
-) error {
+) (MessageSaveResult, error) {
 	sql := `
 	INSERT INTO messages (
 		user_id,
 		room_id,
-		body
+		body,
+		client_id,
+		parent_id
 	)
-	VALUES (
+	SELECT
 		$1,
 		$2,
-		$3
+		$3,
+		$4,
+		(
+			SELECT
+				COALESCE(parent_id, id)
+			FROM messages
+			WHERE
+				1 = 1
+				AND id = $5
+				AND room_id = $2
+		)
+	WHERE
+		$5::UUID IS NULL
+		OR EXISTS (
+			SELECT
+				1
+			FROM messages
+			WHERE
+				1 = 1
+				AND id = $5
+				AND room_id = $2
+		)
+	ON CONFLICT (user_id, room_id, client_id) DO UPDATE
+	SET
+		client_id = EXCLUDED.client_id
+	RETURNING
+		id,
+		timestamp,
+		parent_id,
+		xmax::text <> '0' AS duplicate
+	;
+	`
+	rows, err := r.PgPool.Query(
+		ctx,
+		sql,
+		dto.UserId,
+		dto.RoomId,
+		dto.Body,
+		dto.ClientId,
+		dto.ParentId,
+	)
+	defer rows.Close()
+	if err != nil {
+		return MessageSaveResult{}, err
+	}
+	return pgx.CollectExactlyOneRow(
+		rows,
+		pgx.RowToStructByName[MessageSaveResult],
 	)
+}
+
+// the columns every message query returns, with the parent quoted, the
+// replies counted and the reactions aggregated; queries append their own
+// conditions and ordering
+const messageSelect = `
+	SELECT
+		messages.id,
+		messages.user_id,
+		messages.room_id,
+		users.username,
+		messages.body,
+		messages.timestamp,
+		messages.edited_at,
+		messages.deleted_at,
+		messages.parent_id,
+		parent_users.username AS parent_username,
+		parents.body AS parent_body,
+		(
+			SELECT
+				COUNT(*)
+			FROM messages AS replies
+			WHERE
+				1 = 1
+				AND replies.parent_id = messages.id
+				AND replies.deleted_at IS NULL
+		) AS reply_count,
+		COALESCE(
+			(
+				SELECT
+					json_agg(
+						json_build_object(
+							'emoji', grouped.emoji,
+							'count', grouped.count,
+							'userIds', grouped.user_ids
+						)
+						ORDER BY grouped.first_reacted_at
+					)
+				FROM (
+					SELECT
+						emoji,
+						COUNT(*) AS count,
+						array_agg(user_id) AS user_ids,
+						MIN(created_at) AS first_reacted_at
+					FROM message_reactions
+					WHERE
+						message_id = messages.id
+					GROUP BY
+						emoji
+				) AS grouped
+			),
+			'[]'
+		) AS reactions
+	FROM messages
+		INNER JOIN users ON users.id = messages.user_id
+		LEFT JOIN messages AS parents ON parents.id = messages.parent_id
+		LEFT JOIN users AS parent_users ON parent_users.id = parents.user_id
+`
+
+type Reaction struct {
+	Emoji   string      `json:"emoji"`
+	Count   int         `json:"count"`
+	UserIds []uuid.UUID `json:"userIds"`
+}
+
+type MessageFindOneParams struct {
+	MessageId uuid.UUID
+}
+
+type MessageFindOneResult struct {
+	MessageId      uuid.UUID  `db:"id" json:"messageId"`
+	UserId         uuid.UUID  `db:"user_id" json:"userId"`
+	RoomId         uuid.UUID  `db:"room_id" json:"roomId"`
+	Username       string     `db:"username" json:"username"`
+	Body           string     `db:"body" json:"body"`
+	Timestamp      time.Time  `db:"timestamp" json:"timestamp"`
+	EditedAt       *time.Time `db:"edited_at" json:"editedAt"`
+	DeletedAt      *time.Time `db:"deleted_at" json:"deletedAt"`
+	ParentId       *uuid.UUID `db:"parent_id" json:"parentId"`
+	ParentUsername *string    `db:"parent_username" json:"parentUsername"`
+	ParentBody     *string    `db:"parent_body" json:"parentBody"`
+	ReplyCount     int        `db:"reply_count" json:"replyCount"`
+	Reactions      []Reaction `db:"reactions" json:"reactions"`
+}
+
+func (r *Repository) MessageFindOne(
+	ctx context.Context,
+	dto MessageFindOneParams,
+) (MessageFindOneResult, error) {
+	sql := messageSelect + `
+	WHERE
+		messages.id = $1
 	;
 	`
-	rows, err := r.PgPool.Query(ctx, sql, dto.UserId, dto.RoomId, dto.Body)
+	rows, err := r.PgPool.Query(ctx, sql, dto.MessageId)
 	defer rows.Close()
-	return err
+	if err != nil {
+		return MessageFindOneResult{}, err
+	}
+	return pgx.CollectExactlyOneRow(
+		rows,
+		pgx.RowToStructByName[MessageFindOneResult],
+	)
 }
 
 type MessagesFindManyByRoomIdParams struct {
 	RoomId uuid.UUID
+	Before *uuid.UUID
+	Limit  int
 }
 
 type MessagesFindManyByRoomIdResult struct {
+	MessageId      uuid.UUID  `db:"id" json:"messageId"`
+	UserId         uuid.UUID  `db:"user_id" json:"userId"`
+	RoomId         uuid.UUID  `db:"room_id" json:"roomId"`
+	Username       string     `db:"username" json:"username"`
+	Body           string     `db:"body" json:"body"`
+	Timestamp      time.Time  `db:"timestamp" json:"timestamp"`
+	EditedAt       *time.Time `db:"edited_at" json:"editedAt"`
+	DeletedAt      *time.Time `db:"deleted_at" json:"deletedAt"`
+	ParentId       *uuid.UUID `db:"parent_id" json:"parentId"`
+	ParentUsername *string    `db:"parent_username" json:"parentUsername"`
+	ParentBody     *string    `db:"parent_body" json:"parentBody"`
+	ReplyCount     int        `db:"reply_count" json:"replyCount"`
+	Reactions      []Reaction `db:"reactions" json:"reactions"`
+}
+
+// the latest messages strictly before the given message in (timestamp, id)
+// order, or the latest messages of the room when no message is given;
+// results are in ascending order
+func (r *Repository) MessagesFindManyByRoomId(
+	ctx context.Context,
+	dto MessagesFindManyByRoomIdParams,
+) ([]MessagesFindManyByRoomIdResult, error) {
+	sql := `
+	SELECT
+		*
+	FROM (` + messageSelect + `
+		WHERE
+			1 = 1
+			AND messages.room_id = $1
+			AND (
+				$2::UUID IS NULL
+				OR (messages.timestamp, messages.id) < (
+					SELECT
+						timestamp,
+						id
+					FROM messages
+					WHERE
+						id = $2
+				)
+			)
+		ORDER BY
+			messages.timestamp DESC,
+			messages.id DESC
+		LIMIT $3
+	) AS page
+	ORDER BY
+		page.timestamp ASC,
+		page.id ASC
+	;
+	`
+	rows, err := r.PgPool.Query(ctx, sql, dto.RoomId, dto.Before, dto.Limit)
+	defer rows.Close()
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(
+		rows,
+		pgx.RowToStructByName[MessagesFindManyByRoomIdResult],
+	)
+}
+
+type MessagesFindManyByRoomIdAfterParams struct {
+	RoomId    uuid.UUID
+	MessageId *uuid.UUID
+	Limit     int
+}
+
+// messages strictly after the given message in (timestamp, id) order, or from
+// the start of the room when no message is given
+func (r *Repository) MessagesFindManyByRoomIdAfter(
+	ctx context.Context,
+	dto MessagesFindManyByRoomIdAfterParams,
+) ([]MessagesFindManyByRoomIdResult, error) {
+	sql := messageSelect + `
+	WHERE
+		1 = 1
+		AND messages.room_id = $1
+		AND (
+			$2::UUID IS NULL
+			OR (messages.timestamp, messages.id) > (
+				SELECT
+					timestamp,
+					id
+				FROM messages
+				WHERE
+					id = $2
+			)
+		)
+	ORDER BY
+		messages.timestamp ASC,
+		messages.id ASC
+	LIMIT $3
+	;
+	`
+	rows, err := r.PgPool.Query(ctx, sql, dto.RoomId, dto.MessageId, dto.Limit)
+	defer rows.Close()
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(
+		rows,
+		pgx.RowToStructByName[MessagesFindManyByRoomIdResult],
+	)
+}
+
+type MessageUpdateParams struct {
+	MessageId uuid.UUID
+	RoomId    uuid.UUID
+	UserId    uuid.UUID
+	Body      string
+}
+
+// only the author can update a message that has not been deleted
+func (r *Repository) MessageUpdate(
+	ctx context.Context,
+	dto MessageUpdateParams,
+) (bool, error) {
+	sql := `
+	UPDATE messages
+	SET
+		body = $1,
+		edited_at = CURRENT_TIMESTAMP
+	WHERE
+		1 = 1
+		AND id = $2
+		AND room_id = $3
+		AND user_id = $4
+		AND deleted_at IS NULL
+	RETURNING
+		id
+	;
+	`
+	rows, err := r.PgPool.Query(
+		ctx,
+		sql,
+		dto.Body,
+		dto.MessageId,
+		dto.RoomId,
+		dto.UserId,
+	)
+	defer rows.Close()
+	if err != nil {
+		return false, err
+	}
+	ids, err := pgx.CollectRows(rows, pgx.RowTo[uuid.UUID])
+	return len(ids) > 0, err
+}
+
+type MessageDeleteParams struct {
+	MessageId uuid.UUID
+	RoomId    uuid.UUID
+	UserId    uuid.UUID
+}
+
+// soft deletes a message by clearing its body, only the author can delete
+func (r *Repository) MessageDelete(
+	ctx context.Context,
+	dto MessageDeleteParams,
+) (bool, error) {
+	sql := `
+	UPDATE messages
+	SET
+		body = '',
+		deleted_at = CURRENT_TIMESTAMP
+	WHERE
+		1 = 1
+		AND id = $1
+		AND room_id = $2
+		AND user_id = $3
+		AND deleted_at IS NULL
+	RETURNING
+		id
+	;
+	`
+	rows, err := r.PgPool.Query(
+		ctx,
+		sql,
+		dto.MessageId,
+		dto.RoomId,
+		dto.UserId,
+	)
+	defer rows.Close()
+	if err != nil {
+		return false, err
+	}
+	ids, err := pgx.CollectRows(rows, pgx.RowTo[uuid.UUID])
+	return len(ids) > 0, err
+}
+
+type MessagesFindManyByParentIdParams struct {
+	ParentId uuid.UUID
+}
+
+func (r *Repository) MessagesFindManyByParentId(
+	ctx context.Context,
+	dto MessagesFindManyByParentIdParams,
+) ([]MessagesFindManyByRoomIdResult, error) {
+	sql := messageSelect + `
+	WHERE
+		messages.parent_id = $1
+	ORDER BY
+		messages.timestamp ASC,
+		messages.id ASC
+	;
+	`
+	rows, err := r.PgPool.Query(ctx, sql, dto.ParentId)
+	defer rows.Close()
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(
+		rows,
+		pgx.RowToStructByName[MessagesFindManyByRoomIdResult],
+	)
+}
+
+type MessagesSearchParams struct {
+	UserId uuid.UUID
+	Query  string
+	RoomId *uuid.UUID
+	Author *string
+	From   *time.Time
+	To     *time.Time
+	Limit  int
+	Offset int
+}
+
+type MessagesSearchResult struct {
 	MessageId uuid.UUID `db:"id" json:"messageId"`
-	UserId    uuid.UUID `db:"user_id" json:"userId"`
 	RoomId    uuid.UUID `db:"room_id" json:"roomId"`
+	RoomName  string    `db:"room_name" json:"roomName"`
+	UserId    uuid.UUID `db:"user_id" json:"userId"`
 	Username  string    `db:"username" json:"username"`
 	Body      string    `db:"body" json:"body"`
+	// HTML escaped body excerpt with matches wrapped in <mark> tags
+	Headline  string    `db:"headline" json:"headline"`
+	Rank      float32   `db:"rank" json:"rank"`
 	Timestamp time.Time `db:"timestamp" json:"timestamp"`
 }
 
-func (r *Repository) MessagesFindManyByRoomId(
+// ranks matching messages in every room the user belongs to
+func (r *Repository) MessagesSearch(
 	ctx context.Context,
-	dto MessagesFindManyByRoomIdParams,
-) ([]MessagesFindManyByRoomIdResult, error) {
+	dto MessagesSearchParams,
+) ([]MessagesSearchResult, error) {
 	sql := `
 	SELECT
 		messages.id,
-		messages.user_id,
 		messages.room_id,
+		rooms.name AS room_name,
+		messages.user_id,
 		users.username,
 		messages.body,
+		ts_headline(
+			'english',
+			translate(messages.body, $9, '  '),
+			query,
+			$10
+		) AS headline,
+		ts_rank(messages.body_tsv, query) AS rank,
 		messages.timestamp
 	FROM messages
+		INNER JOIN websearch_to_tsquery('english', $2) AS query ON messages.body_tsv @@ query
+		INNER JOIN room_users ON room_users.room_id = messages.room_id
+		INNER JOIN rooms ON rooms.id = messages.room_id
 		INNER JOIN users ON users.id = messages.user_id
 	WHERE
-		room_id = $1
+		1 = 1
+		AND room_users.user_id = $1
+		AND messages.deleted_at IS NULL
+		AND ($3::uuid IS NULL OR messages.room_id = $3)
+		AND ($4::text IS NULL OR users.username = $4)
+		AND ($5::timestamptz IS NULL OR messages.timestamp >= $5)
+		AND ($6::timestamptz IS NULL OR messages.timestamp < $6)
 	ORDER BY
-		messages.timestamp ASC
+		rank DESC,
+		messages.timestamp DESC,
+		messages.id DESC
+	LIMIT $7
+	OFFSET $8
 	;
 	`
-	rows, err := r.PgPool.Query(ctx, sql, dto.RoomId)
+	rows, err := r.PgPool.Query(
+		ctx,
+		sql,
+		dto.UserId,
+		dto.Query,
+		dto.RoomId,
+		dto.Author,
+		dto.From,
+		dto.To,
+		dto.Limit,
+		dto.Offset,
+		HEADLINE_START+HEADLINE_STOP,
+		fmt.Sprintf(
+			`StartSel="%s", StopSel="%s", MaxFragments=2`,
+			HEADLINE_START,
+			HEADLINE_STOP,
+		),
+	)
 	defer rows.Close()
 	if err != nil {
 		return nil, err
 	}
-	return pgx.CollectRows(
+	results, err := pgx.CollectRows(
 		rows,
-		pgx.RowToStructByName[MessagesFindManyByRoomIdResult],
+		pgx.RowToStructByName[MessagesSearchResult],
+	)
+	if err != nil {
+		return nil, err
+	}
+	// highlighted from the body as indexed, then escaped for the page
+	marks := strings.NewReplacer(
+		HEADLINE_START, "<mark>",
+		HEADLINE_STOP, "</mark>",
+	)
+	for i := range results {
+		results[i].Headline = marks.Replace(
+			html.EscapeString(results[i].Headline),
+		)
+	}
+	return results, nil
+}
+
+type ReactionAddParams struct {
+	MessageId uuid.UUID
+	RoomId    uuid.UUID
+	UserId    uuid.UUID
+	Emoji     string
+}
+
+// nothing is added when the message is not in the room, has been deleted or
+// already has the same reaction from the user
+func (r *Repository) ReactionAdd(
+	ctx context.Context,
+	dto ReactionAddParams,
+) (bool, error) {
+	sql := `
+	INSERT INTO message_reactions (
+		message_id,
+		user_id,
+		emoji
+	)
+	SELECT
+		id,
+		$3,
+		$4
+	FROM messages
+	WHERE
+		1 = 1
+		AND id = $1
+		AND room_id = $2
+		AND deleted_at IS NULL
+	ON CONFLICT DO NOTHING
+	RETURNING
+		message_id
+	;
+	`
+	rows, err := r.PgPool.Query(
+		ctx,
+		sql,
+		dto.MessageId,
+		dto.RoomId,
+		dto.UserId,
+		dto.Emoji,
 	)
+	defer rows.Close()
+	if err != nil {
+		return false, err
+	}
+	ids, err := pgx.CollectRows(rows, pgx.RowTo[uuid.UUID])
+	return len(ids) > 0, err
+}
+
+type ReactionRemoveParams struct {
+	MessageId uuid.UUID
+	RoomId    uuid.UUID
+	UserId    uuid.UUID
+	Emoji     string
+}
+
+func (r *Repository) ReactionRemove(
+	ctx context.Context,
+	dto ReactionRemoveParams,
+) (bool, error) {
+	sql := `
+	DELETE FROM message_reactions
+	USING messages
+	WHERE
+		1 = 1
+		AND messages.id = message_reactions.message_id
+		AND message_reactions.message_id = $1
+		AND messages.room_id = $2
+		AND message_reactions.user_id = $3
+		AND message_reactions.emoji = $4
+	RETURNING
+		message_reactions.message_id
+	;
+	`
+	rows, err := r.PgPool.Query(
+		ctx,
+		sql,
+		dto.MessageId,
+		dto.RoomId,
+		dto.UserId,
+		dto.Emoji,
+	)
+	defer rows.Close()
+	if err != nil {
+		return false, err
+	}
+	ids, err := pgx.CollectRows(rows, pgx.RowTo[uuid.UUID])
+	return len(ids) > 0, err
 }
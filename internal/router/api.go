@@ -1,10 +1,13 @@
 package router
 
 import (
+	"gossip/internal/chat"
 	"gossip/internal/repository"
 	"gossip/internal/utils/password"
 	"log/slog"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
@@ -19,7 +22,7 @@ func (router *Router) apiRouter() *chi.Mux {
 }
 
 func (router *Router) apiRouteGroup(mux chi.Router) {
-	mux.Post("/signup", func(w http.ResponseWriter, r *http.Request) {
+	mux.With(router.authRateLimitMiddleware).Post("/signup", func(w http.ResponseWriter, r *http.Request) {
 		body, err := readJSON[struct {
 			Username string `json:"username"`
 			Password string `json:"password"`
@@ -58,7 +61,7 @@ func (router *Router) apiRouteGroup(mux chi.Router) {
 		})
 	})
 
-	mux.Post("/login", func(w http.ResponseWriter, r *http.Request) {
+	mux.With(router.authRateLimitMiddleware).Post("/login", func(w http.ResponseWriter, r *http.Request) {
 		body, err := readJSON[struct {
 			Username string `json:"username"`
 			Password string `json:"password"`
@@ -130,6 +133,7 @@ func (router *Router) apiAuthedRouteGroup(mux chi.Router) {
 			errorToJSON(w, http.StatusInternalServerError, err)
 			return
 		}
+		router.ChatService.UserLogout(session.UserId, session.SessionId)
 		http.SetCookie(w, &http.Cookie{
 			Name:     SESSION_ID_COOKIE,
 			Path:     "/",
@@ -146,95 +150,884 @@ func (router *Router) apiAuthedRouteGroup(mux chi.Router) {
 
 	mux.Get("/connect", func(w http.ResponseWriter, r *http.Request) {
 		session := sessionFromContextSafe(r.Context())
-		err := router.ChatService.UserConnect(
-			w,
-			r,
-			session.UserId,
-			session.Username,
+		cursors := []chat.Cursor{}
+		for _, value := range r.URL.Query()["cursor"] {
+			cursor, err := chat.ParseCursor(value)
+			if err != nil {
+				slog.Error("error parsing cursor", "cursor", value)
+				errorToJSON(w, http.StatusBadRequest, err)
+				return
+			}
+			cursors = append(cursors, cursor)
+		}
+		clientId := r.URL.Query().Get("client")
+		if len(clientId) > MAX_CONNECTION_CLIENT_ID_LENGTH {
+			errorToJSON(w, http.StatusBadRequest, clientIdTooLongError)
+			return
+		}
+		err := router.ChatService.UserConnect(w, r, chat.UserConnectParams{
+			UserId:    session.UserId,
+			Username:  session.Username,
+			SessionId: session.SessionId,
+			ClientId:  clientId,
+			Cursors:   cursors,
+		})
+		if err != nil {
+			slog.Error("error creating WS connection")
+			errorToJSON(w, chatErrorStatus(err), err)
+			return
+		}
+	})
+
+	mux.Post("/rooms/create", func(w http.ResponseWriter, r *http.Request) {
+		session := sessionFromContextSafe(r.Context())
+		body, err := readJSON[struct {
+			RoomName   string `json:"roomName"`
+			Visibility string `json:"visibility"`
+		}](r)
+		if err != nil {
+			slog.Error("error parsing body")
+			errorToJSON(w, http.StatusBadRequest, err)
+			return
+		}
+		if body.Visibility == "" {
+			body.Visibility = repository.ROOM_VISIBILITY_PUBLIC
+		}
+		if !isRoomVisibility(body.Visibility) {
+			errorToJSON(w, http.StatusBadRequest, invalidRoomVisibilityError)
+			return
+		}
+		room, err := router.Repository.RoomCreate(
+			r.Context(),
+			repository.RoomCreateParams{
+				Name:       body.RoomName,
+				Visibility: body.Visibility,
+				OwnerId:    session.UserId,
+			},
+		)
+		if err != nil {
+			slog.Error("error creating room")
+			errorToJSON(w, http.StatusInternalServerError, err)
+			return
+		}
+		err = router.ChatService.RoomCreate(room.RoomId)
+		if err != nil {
+			slog.Error("error registering room in chat service")
+			errorToJSON(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, baseResponse{
+			Success: true,
+			Message: "room created",
+		})
+	})
+
+	mux.Post("/dms/open", func(w http.ResponseWriter, r *http.Request) {
+		session := sessionFromContextSafe(r.Context())
+		body, err := readJSON[struct {
+			Username string `json:"username"`
+		}](r)
+		if err != nil {
+			slog.Error("error parsing body")
+			errorToJSON(w, http.StatusBadRequest, err)
+			return
+		}
+		other, err := router.Repository.UserFindOneByUsername(
+			r.Context(),
+			repository.UserFindOneByUsernameParams{Username: body.Username},
+		)
+		if err != nil {
+			slog.Error("error finding user", "body.Username", body.Username)
+			errorToJSON(w, http.StatusNotFound, userNotFoundError)
+			return
+		}
+		if other.UserId == session.UserId {
+			errorToJSON(w, http.StatusBadRequest, directRoomSelfError)
+			return
+		}
+		room, err := router.Repository.DirectRoomOpen(
+			r.Context(),
+			repository.DirectRoomOpenParams{
+				UserId:      session.UserId,
+				OtherUserId: other.UserId,
+			},
+		)
+		if err != nil {
+			slog.Error("error opening direct room", "userId", other.UserId)
+			errorToJSON(w, http.StatusInternalServerError, err)
+			return
+		}
+		if room.Created {
+			err = router.ChatService.RoomCreate(room.RoomId)
+			if err != nil {
+				slog.Error("error registering room in chat service")
+				errorToJSON(w, http.StatusInternalServerError, err)
+				return
+			}
+		}
+		writeJSON(w, http.StatusOK, baseResponse{
+			Success: true,
+			Message: "direct room opened",
+			Data: map[string]any{
+				"room": map[string]any{
+					"id": room.RoomId,
+				},
+			},
+		})
+	})
+
+	mux.Post("/rooms/join", func(w http.ResponseWriter, r *http.Request) {
+		session := sessionFromContextSafe(r.Context())
+		body, err := readJSON[struct {
+			RoomId   string `json:"roomId"`
+			InviteId string `json:"inviteId"`
+		}](r)
+		if err != nil {
+			slog.Error("error parsing body")
+			errorToJSON(w, http.StatusBadRequest, err)
+			return
+		}
+		params := repository.UserJoinRoomParams{UserId: session.UserId}
+		if body.InviteId != "" {
+			inviteId, err := uuid.FromString(body.InviteId)
+			if err != nil {
+				slog.Error("error parsing inviteId", "body.InviteId", body.InviteId)
+				errorToJSON(w, http.StatusNotFound, repository.InvalidInviteError)
+				return
+			}
+			params.InviteId = &inviteId
+		} else {
+			roomId, err := uuid.FromString(body.RoomId)
+			if err != nil {
+				slog.Error("error parsing roomId", "body.RoomId", body.RoomId)
+				errorToJSON(w, http.StatusBadRequest, err)
+				return
+			}
+			params.RoomId = roomId
+		}
+		result, err := router.Repository.UserJoinRoom(r.Context(), params)
+		if err != nil {
+			slog.Error("error joining room", "error", err.Error())
+			errorToJSON(w, joinErrorStatus(err), joinError(err))
+			return
+		}
+		message := "room joined"
+		switch result.Status {
+		case repository.ROOM_JOIN_STATUS_JOINED:
+			router.ChatService.UserJoinRoom(session.UserId, result.RoomId)
+		case repository.ROOM_JOIN_STATUS_REQUESTED:
+			message = "join request sent"
+		case repository.ROOM_JOIN_STATUS_MEMBER:
+			message = "already a member"
+		}
+		writeJSON(w, http.StatusOK, baseResponse{
+			Success: true,
+			Message: message,
+			Data: map[string]any{
+				"roomId": result.RoomId,
+				"status": result.Status,
+			},
+		})
+	})
+
+	mux.Post("/rooms/visibility", func(w http.ResponseWriter, r *http.Request) {
+		session := sessionFromContextSafe(r.Context())
+		body, err := readJSON[struct {
+			RoomId     string `json:"roomId"`
+			Visibility string `json:"visibility"`
+		}](r)
+		if err != nil {
+			slog.Error("error parsing body")
+			errorToJSON(w, http.StatusBadRequest, err)
+			return
+		}
+		if !isRoomVisibility(body.Visibility) {
+			errorToJSON(w, http.StatusBadRequest, invalidRoomVisibilityError)
+			return
+		}
+		roomId, err := uuid.FromString(body.RoomId)
+		if err != nil {
+			slog.Error("error parsing roomId", "body.RoomId", body.RoomId)
+			errorToJSON(w, http.StatusBadRequest, err)
+			return
+		}
+		if _, ok := router.authorizeRoomManager(w, r, session.UserId, roomId); !ok {
+			return
+		}
+		err = router.Repository.RoomUpdate(
+			r.Context(),
+			repository.RoomUpdateParams{
+				RoomId:     roomId,
+				Visibility: &body.Visibility,
+			},
+		)
+		if err != nil {
+			slog.Error("error updating room visibility", "roomId", roomId)
+			errorToJSON(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, baseResponse{
+			Success: true,
+			Message: "room visibility updated",
+		})
+	})
+
+	mux.Post("/rooms/invites/create", func(w http.ResponseWriter, r *http.Request) {
+		session := sessionFromContextSafe(r.Context())
+		body, err := readJSON[struct {
+			RoomId    string `json:"roomId"`
+			ExpiresIn *int   `json:"expiresIn"`
+			MaxUses   *int   `json:"maxUses"`
+		}](r)
+		if err != nil {
+			slog.Error("error parsing body")
+			errorToJSON(w, http.StatusBadRequest, err)
+			return
+		}
+		if (body.ExpiresIn != nil && *body.ExpiresIn < 1) ||
+			(body.MaxUses != nil && *body.MaxUses < 1) {
+			errorToJSON(w, http.StatusBadRequest, invalidInviteOptionsError)
+			return
+		}
+		roomId, err := uuid.FromString(body.RoomId)
+		if err != nil {
+			slog.Error("error parsing roomId", "body.RoomId", body.RoomId)
+			errorToJSON(w, http.StatusBadRequest, err)
+			return
+		}
+		if _, ok := router.authorizeRoomManager(w, r, session.UserId, roomId); !ok {
+			return
+		}
+		var expiresOn *time.Time
+		if body.ExpiresIn != nil {
+			value := time.Now().Add(time.Duration(*body.ExpiresIn) * time.Second)
+			expiresOn = &value
+		}
+		invite, err := router.Repository.RoomInviteCreate(
+			r.Context(),
+			repository.RoomInviteCreateParams{
+				RoomId:    roomId,
+				CreatedBy: session.UserId,
+				ExpiresOn: expiresOn,
+				MaxUses:   body.MaxUses,
+			},
+		)
+		if err != nil {
+			slog.Error("error creating invite", "roomId", roomId)
+			errorToJSON(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, baseResponse{
+			Success: true,
+			Message: "invite created",
+			Data: map[string]any{
+				"invite": invite,
+			},
+		})
+	})
+
+	mux.Get("/rooms/{roomId}/invites", func(w http.ResponseWriter, r *http.Request) {
+		session := sessionFromContextSafe(r.Context())
+		roomId, err := uuid.FromString(chi.URLParam(r, "roomId"))
+		if err != nil {
+			slog.Error("error parsing roomId")
+			errorToJSON(w, http.StatusBadRequest, err)
+			return
+		}
+		if _, ok := router.authorizeRoomManager(w, r, session.UserId, roomId); !ok {
+			return
+		}
+		invites, err := router.Repository.RoomInvitesFindManyByRoomId(
+			r.Context(),
+			repository.RoomInvitesFindManyByRoomIdParams{RoomId: roomId},
+		)
+		if err != nil {
+			slog.Error("error finding invites", "roomId", roomId)
+			errorToJSON(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, baseResponse{
+			Success: true,
+			Message: "invites found",
+			Data: map[string]any{
+				"invites": invites,
+			},
+		})
+	})
+
+	mux.Post("/rooms/invites/revoke", func(w http.ResponseWriter, r *http.Request) {
+		session := sessionFromContextSafe(r.Context())
+		body, err := readJSON[struct {
+			RoomId   string `json:"roomId"`
+			InviteId string `json:"inviteId"`
+		}](r)
+		if err != nil {
+			slog.Error("error parsing body")
+			errorToJSON(w, http.StatusBadRequest, err)
+			return
+		}
+		roomId, err := uuid.FromString(body.RoomId)
+		if err != nil {
+			slog.Error("error parsing roomId", "body.RoomId", body.RoomId)
+			errorToJSON(w, http.StatusBadRequest, err)
+			return
+		}
+		inviteId, err := uuid.FromString(body.InviteId)
+		if err != nil {
+			slog.Error("error parsing inviteId", "body.InviteId", body.InviteId)
+			errorToJSON(w, http.StatusBadRequest, err)
+			return
+		}
+		if _, ok := router.authorizeRoomManager(w, r, session.UserId, roomId); !ok {
+			return
+		}
+		deleted, err := router.Repository.RoomInviteDelete(
+			r.Context(),
+			repository.RoomInviteDeleteParams{
+				InviteId: inviteId,
+				RoomId:   roomId,
+			},
+		)
+		if err != nil {
+			slog.Error("error revoking invite", "inviteId", inviteId)
+			errorToJSON(w, http.StatusInternalServerError, err)
+			return
+		}
+		if !deleted {
+			errorToJSON(w, http.StatusNotFound, repository.InvalidInviteError)
+			return
+		}
+		writeJSON(w, http.StatusOK, baseResponse{
+			Success: true,
+			Message: "invite revoked",
+		})
+	})
+
+	mux.Get("/rooms/{roomId}/requests", func(w http.ResponseWriter, r *http.Request) {
+		session := sessionFromContextSafe(r.Context())
+		roomId, err := uuid.FromString(chi.URLParam(r, "roomId"))
+		if err != nil {
+			slog.Error("error parsing roomId")
+			errorToJSON(w, http.StatusBadRequest, err)
+			return
+		}
+		if _, ok := router.authorizeRoomManager(w, r, session.UserId, roomId); !ok {
+			return
+		}
+		requests, err := router.Repository.RoomJoinRequestsFindManyByRoomId(
+			r.Context(),
+			repository.RoomJoinRequestsFindManyByRoomIdParams{RoomId: roomId},
+		)
+		if err != nil {
+			slog.Error("error finding join requests", "roomId", roomId)
+			errorToJSON(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, baseResponse{
+			Success: true,
+			Message: "join requests found",
+			Data: map[string]any{
+				"requests": requests,
+			},
+		})
+	})
+
+	mux.Post("/rooms/requests/{decision}", func(w http.ResponseWriter, r *http.Request) {
+		session := sessionFromContextSafe(r.Context())
+		decision := chi.URLParam(r, "decision")
+		if decision != "approve" && decision != "reject" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		body, err := readJSON[struct {
+			RoomId string `json:"roomId"`
+			UserId string `json:"userId"`
+		}](r)
+		if err != nil {
+			slog.Error("error parsing body")
+			errorToJSON(w, http.StatusBadRequest, err)
+			return
+		}
+		roomId, err := uuid.FromString(body.RoomId)
+		if err != nil {
+			slog.Error("error parsing roomId", "body.RoomId", body.RoomId)
+			errorToJSON(w, http.StatusBadRequest, err)
+			return
+		}
+		userId, err := uuid.FromString(body.UserId)
+		if err != nil {
+			slog.Error("error parsing userId", "body.UserId", body.UserId)
+			errorToJSON(w, http.StatusBadRequest, err)
+			return
+		}
+		if _, ok := router.authorizeRoomManager(w, r, session.UserId, roomId); !ok {
+			return
+		}
+		var found bool
+		if decision == "approve" {
+			found, err = router.Repository.RoomJoinRequestApprove(
+				r.Context(),
+				repository.RoomJoinRequestApproveParams{
+					UserId: userId,
+					RoomId: roomId,
+				},
+			)
+		} else {
+			found, err = router.Repository.RoomJoinRequestDelete(
+				r.Context(),
+				repository.RoomJoinRequestDeleteParams{
+					UserId: userId,
+					RoomId: roomId,
+				},
+			)
+		}
+		if err != nil {
+			slog.Error("error resolving join request", "userId", userId)
+			errorToJSON(w, http.StatusInternalServerError, err)
+			return
+		}
+		if !found {
+			errorToJSON(w, http.StatusNotFound, joinRequestNotFoundError)
+			return
+		}
+		if decision == "approve" {
+			router.ChatService.UserJoinRoom(userId, roomId)
+		}
+		writeJSON(w, http.StatusOK, baseResponse{
+			Success: true,
+			Message: "join request " + decision + "d",
+		})
+	})
+
+	mux.Post("/rooms/rename", func(w http.ResponseWriter, r *http.Request) {
+		session := sessionFromContextSafe(r.Context())
+		body, err := readJSON[struct {
+			RoomId string `json:"roomId"`
+			Name   string `json:"name"`
+		}](r)
+		if err != nil {
+			slog.Error("error parsing body")
+			errorToJSON(w, http.StatusBadRequest, err)
+			return
+		}
+		if body.Name == "" {
+			errorToJSON(w, http.StatusBadRequest, emptyRoomNameError)
+			return
+		}
+		roomId, err := uuid.FromString(body.RoomId)
+		if err != nil {
+			slog.Error("error parsing roomId", "body.RoomId", body.RoomId)
+			errorToJSON(w, http.StatusBadRequest, err)
+			return
+		}
+		if _, ok := router.authorizeRoomManager(w, r, session.UserId, roomId); !ok {
+			return
+		}
+		err = router.Repository.RoomUpdate(
+			r.Context(),
+			repository.RoomUpdateParams{RoomId: roomId, Name: &body.Name},
+		)
+		if err != nil {
+			slog.Error("error renaming room", "roomId", roomId)
+			errorToJSON(w, http.StatusInternalServerError, err)
+			return
+		}
+		router.ChatService.RoomRename(roomId, body.Name)
+		writeJSON(w, http.StatusOK, baseResponse{
+			Success: true,
+			Message: "room renamed",
+		})
+	})
+
+	mux.Post("/rooms/delete", func(w http.ResponseWriter, r *http.Request) {
+		session := sessionFromContextSafe(r.Context())
+		body, err := readJSON[struct {
+			RoomId string `json:"roomId"`
+		}](r)
+		if err != nil {
+			slog.Error("error parsing body")
+			errorToJSON(w, http.StatusBadRequest, err)
+			return
+		}
+		roomId, err := uuid.FromString(body.RoomId)
+		if err != nil {
+			slog.Error("error parsing roomId", "body.RoomId", body.RoomId)
+			errorToJSON(w, http.StatusBadRequest, err)
+			return
+		}
+		if _, ok := router.authorizeRoomManager(w, r, session.UserId, roomId); !ok {
+			return
+		}
+		err = router.Repository.RoomDelete(
+			r.Context(),
+			repository.RoomDeleteParams{RoomId: roomId},
+		)
+		if err != nil {
+			slog.Error("error deleting room", "roomId", roomId)
+			errorToJSON(w, http.StatusInternalServerError, err)
+			return
+		}
+		router.ChatService.RoomDelete(roomId)
+		writeJSON(w, http.StatusOK, baseResponse{
+			Success: true,
+			Message: "room deleted",
+		})
+	})
+
+	mux.Post("/rooms/kick", func(w http.ResponseWriter, r *http.Request) {
+		session := sessionFromContextSafe(r.Context())
+		body, err := readJSON[struct {
+			RoomId string `json:"roomId"`
+			UserId string `json:"userId"`
+		}](r)
+		if err != nil {
+			slog.Error("error parsing body")
+			errorToJSON(w, http.StatusBadRequest, err)
+			return
+		}
+		roomId, err := uuid.FromString(body.RoomId)
+		if err != nil {
+			slog.Error("error parsing roomId", "body.RoomId", body.RoomId)
+			errorToJSON(w, http.StatusBadRequest, err)
+			return
+		}
+		userId, err := uuid.FromString(body.UserId)
+		if err != nil {
+			slog.Error("error parsing userId", "body.UserId", body.UserId)
+			errorToJSON(w, http.StatusBadRequest, err)
+			return
+		}
+		role, ok := router.authorizeRoomManager(w, r, session.UserId, roomId)
+		if !ok {
+			return
+		}
+		target, err := router.Repository.RoomUserRoleFindOne(
+			r.Context(),
+			repository.RoomUserRoleFindOneParams{
+				UserId: userId,
+				RoomId: roomId,
+			},
 		)
 		if err != nil {
-			slog.Error("error creating WS connection")
+			slog.Error("error finding member", "userId", userId)
+			errorToJSON(w, http.StatusNotFound, chat.NotRoomMemberError)
+			return
+		}
+		if roomRoleRank(role) <= roomRoleRank(target.Role) {
+			errorToJSON(w, http.StatusForbidden, insufficientRoomRoleError)
+			return
+		}
+		err = router.Repository.UserLeaveRoom(
+			r.Context(),
+			repository.UserLeaveRoomParams{
+				UserId: userId,
+				RoomId: roomId,
+			},
+		)
+		if err != nil {
+			slog.Error("error kicking member", "userId", userId)
 			errorToJSON(w, http.StatusInternalServerError, err)
 			return
 		}
+		router.ChatService.UserKick(userId, roomId)
+		writeJSON(w, http.StatusOK, baseResponse{
+			Success: true,
+			Message: "member kicked",
+		})
 	})
 
-	mux.Post("/rooms/create", func(w http.ResponseWriter, r *http.Request) {
+	mux.Post("/rooms/promote", func(w http.ResponseWriter, r *http.Request) {
 		session := sessionFromContextSafe(r.Context())
 		body, err := readJSON[struct {
-			RoomName string `json:"roomName"`
+			RoomId string `json:"roomId"`
+			UserId string `json:"userId"`
+			Role   string `json:"role"`
 		}](r)
 		if err != nil {
 			slog.Error("error parsing body")
 			errorToJSON(w, http.StatusBadRequest, err)
 			return
 		}
-		// TODO: use SQL transaction
-		room, err := router.Repository.RoomCreate(
+		if body.Role != repository.ROOM_ROLE_ADMIN &&
+			body.Role != repository.ROOM_ROLE_MEMBER {
+			errorToJSON(w, http.StatusBadRequest, invalidRoomRoleError)
+			return
+		}
+		roomId, err := uuid.FromString(body.RoomId)
+		if err != nil {
+			slog.Error("error parsing roomId", "body.RoomId", body.RoomId)
+			errorToJSON(w, http.StatusBadRequest, err)
+			return
+		}
+		userId, err := uuid.FromString(body.UserId)
+		if err != nil {
+			slog.Error("error parsing userId", "body.UserId", body.UserId)
+			errorToJSON(w, http.StatusBadRequest, err)
+			return
+		}
+		role, ok := router.authorizeRoomManager(w, r, session.UserId, roomId)
+		if !ok {
+			return
+		}
+		target, err := router.Repository.RoomUserRoleFindOne(
 			r.Context(),
-			repository.RoomCreateParams{Name: body.RoomName},
+			repository.RoomUserRoleFindOneParams{
+				UserId: userId,
+				RoomId: roomId,
+			},
 		)
 		if err != nil {
-			slog.Error("error creating room")
-			errorToJSON(w, http.StatusInternalServerError, err)
+			slog.Error("error finding member", "userId", userId)
+			errorToJSON(w, http.StatusNotFound, chat.NotRoomMemberError)
+			return
+		}
+		if roomRoleRank(role) <= roomRoleRank(target.Role) ||
+			roomRoleRank(role) < roomRoleRank(body.Role) {
+			errorToJSON(w, http.StatusForbidden, insufficientRoomRoleError)
 			return
 		}
-		err = router.Repository.UserJoinRoom(
+		err = router.Repository.RoomUserRoleUpdate(
 			r.Context(),
-			repository.UserJoinRoomParams{
-				UserId: session.UserId,
-				RoomId: room.RoomId,
+			repository.RoomUserRoleUpdateParams{
+				UserId: userId,
+				RoomId: roomId,
+				Role:   body.Role,
 			},
 		)
 		if err != nil {
-			slog.Error("error joining room")
+			slog.Error("error updating member role", "userId", userId)
 			errorToJSON(w, http.StatusInternalServerError, err)
 			return
 		}
-		err = router.ChatService.RoomCreate(room.RoomId)
+		writeJSON(w, http.StatusOK, baseResponse{
+			Success: true,
+			Message: "member role updated",
+		})
+	})
+
+	mux.Get("/search", func(w http.ResponseWriter, r *http.Request) {
+		session := sessionFromContextSafe(r.Context())
+		query := r.URL.Query()
+		params := repository.MessagesSearchParams{
+			UserId: session.UserId,
+			Query:  strings.TrimSpace(query.Get("q")),
+			Limit:  SEARCH_PAGE_LIMIT,
+		}
+		if params.Query == "" {
+			errorToJSON(w, http.StatusBadRequest, emptySearchQueryError)
+			return
+		}
+		if value := query.Get("roomId"); value != "" {
+			roomId, err := uuid.FromString(value)
+			if err != nil {
+				slog.Error("error parsing roomId", "roomId", value)
+				errorToJSON(w, http.StatusBadRequest, err)
+				return
+			}
+			params.RoomId = &roomId
+		}
+		if value := query.Get("author"); value != "" {
+			params.Author = &value
+		}
+		var err error
+		if params.From, err = parseSearchTime(query.Get("from"), false); err != nil {
+			errorToJSON(w, http.StatusBadRequest, err)
+			return
+		}
+		if params.To, err = parseSearchTime(query.Get("to"), true); err != nil {
+			errorToJSON(w, http.StatusBadRequest, err)
+			return
+		}
+		if value := query.Get("limit"); value != "" {
+			params.Limit, err = strconv.Atoi(value)
+			if err != nil || params.Limit < 1 || params.Limit > SEARCH_PAGE_LIMIT_MAX {
+				slog.Error("error parsing limit", "limit", value)
+				errorToJSON(w, http.StatusBadRequest, invalidLimitError)
+				return
+			}
+		}
+		if value := query.Get("offset"); value != "" {
+			params.Offset, err = strconv.Atoi(value)
+			if err != nil || params.Offset < 0 {
+				slog.Error("error parsing offset", "offset", value)
+				errorToJSON(w, http.StatusBadRequest, invalidOffsetError)
+				return
+			}
+		}
+		results, err := router.Repository.MessagesSearch(r.Context(), params)
 		if err != nil {
-			slog.Error("error registering room in chat service")
+			slog.Error("error searching messages", "error", err.Error())
 			errorToJSON(w, http.StatusInternalServerError, err)
 			return
 		}
+		var nextOffset *int
+		if len(results) == params.Limit {
+			value := params.Offset + params.Limit
+			nextOffset = &value
+		}
 		writeJSON(w, http.StatusOK, baseResponse{
 			Success: true,
-			Message: "room created",
+			Message: "messages found",
+			Data: map[string]any{
+				"results":    results,
+				"nextOffset": nextOffset,
+			},
 		})
 	})
 
-	mux.Post("/rooms/join", func(w http.ResponseWriter, r *http.Request) {
+	mux.Get("/rooms/directory", func(w http.ResponseWriter, r *http.Request) {
 		session := sessionFromContextSafe(r.Context())
-		body, err := readJSON[struct {
-			RoomId string `json:"roomId"`
-		}](r)
+		var after *string
+		if value := r.URL.Query().Get("after"); value != "" {
+			after = &value
+		}
+		limit := DIRECTORY_PAGE_LIMIT
+		if value := r.URL.Query().Get("limit"); value != "" {
+			var err error
+			limit, err = strconv.Atoi(value)
+			if err != nil || limit < 1 || limit > DIRECTORY_PAGE_LIMIT_MAX {
+				slog.Error("error parsing limit", "limit", value)
+				errorToJSON(w, http.StatusBadRequest, invalidLimitError)
+				return
+			}
+		}
+		rooms, err := router.Repository.RoomDirectoryFindMany(
+			r.Context(),
+			repository.RoomDirectoryFindManyParams{
+				UserId: session.UserId,
+				Query:  strings.TrimSpace(r.URL.Query().Get("q")),
+				After:  after,
+				Limit:  limit,
+			},
+		)
 		if err != nil {
-			slog.Error("error parsing body")
+			slog.Error("error finding directory rooms", "error", err.Error())
+			errorToJSON(w, http.StatusInternalServerError, err)
+			return
+		}
+		var nextCursor *string
+		if len(rooms) == limit {
+			nextCursor = &rooms[len(rooms)-1].Name
+		}
+		writeJSON(w, http.StatusOK, baseResponse{
+			Success: true,
+			Message: "rooms found",
+			Data: map[string]any{
+				"rooms":      rooms,
+				"nextCursor": nextCursor,
+			},
+		})
+	})
+
+	mux.Get("/rooms/{roomId}/members", func(w http.ResponseWriter, r *http.Request) {
+		session := sessionFromContextSafe(r.Context())
+		roomId, err := uuid.FromString(chi.URLParam(r, "roomId"))
+		if err != nil {
+			slog.Error("error parsing roomId", "roomId", chi.URLParam(r, "roomId"))
 			errorToJSON(w, http.StatusBadRequest, err)
 			return
 		}
-		roomId, err := uuid.FromString(body.RoomId)
+		isMember, err := router.Repository.UserCheckRoomMembership(
+			r.Context(),
+			repository.UserCheckRoomMembershipParams{
+				UserId: session.UserId,
+				RoomId: roomId,
+			},
+		)
 		if err != nil {
-			slog.Error("error parsing roomId", "body.RoomId", body.RoomId)
+			slog.Error("error checking room membership", "roomId", roomId)
+			errorToJSON(w, http.StatusInternalServerError, err)
+			return
+		}
+		if !isMember {
+			errorToJSON(w, http.StatusForbidden, chat.NotRoomMemberError)
+			return
+		}
+		members, err := router.Repository.UsersFindManyByRoomId(
+			r.Context(),
+			repository.UsersFindManyByRoomIdParams{RoomId: roomId},
+		)
+		if err != nil {
+			slog.Error("error finding room members", "roomId", roomId)
+			errorToJSON(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, baseResponse{
+			Success: true,
+			Message: "members found",
+			Data: map[string]any{
+				"members": members,
+			},
+		})
+	})
+
+	mux.Get("/rooms/{roomId}/messages", func(w http.ResponseWriter, r *http.Request) {
+		session := sessionFromContextSafe(r.Context())
+		roomId, err := uuid.FromString(chi.URLParam(r, "roomId"))
+		if err != nil {
+			slog.Error("error parsing roomId", "roomId", chi.URLParam(r, "roomId"))
 			errorToJSON(w, http.StatusBadRequest, err)
 			return
 		}
-		err = router.Repository.UserJoinRoom(
+		var before *uuid.UUID
+		if value := r.URL.Query().Get("before"); value != "" {
+			messageId, err := uuid.FromString(value)
+			if err != nil {
+				slog.Error("error parsing before", "before", value)
+				errorToJSON(w, http.StatusBadRequest, err)
+				return
+			}
+			before = &messageId
+		}
+		limit := MESSAGES_PAGE_LIMIT
+		if value := r.URL.Query().Get("limit"); value != "" {
+			limit, err = strconv.Atoi(value)
+			if err != nil || limit < 1 || limit > MESSAGES_PAGE_LIMIT_MAX {
+				slog.Error("error parsing limit", "limit", value)
+				errorToJSON(w, http.StatusBadRequest, invalidLimitError)
+				return
+			}
+		}
+		isMember, err := router.Repository.UserCheckRoomMembership(
 			r.Context(),
-			repository.UserJoinRoomParams{
+			repository.UserCheckRoomMembershipParams{
 				UserId: session.UserId,
 				RoomId: roomId,
 			},
 		)
 		if err != nil {
-			slog.Error("error joining room")
+			slog.Error("error checking room membership", "roomId", roomId)
 			errorToJSON(w, http.StatusInternalServerError, err)
 			return
 		}
-		router.ChatService.UserJoinRoom(session.UserId, roomId)
+		if !isMember {
+			errorToJSON(w, http.StatusForbidden, chat.NotRoomMemberError)
+			return
+		}
+		messages, err := router.Repository.MessagesFindManyByRoomId(
+			r.Context(),
+			repository.MessagesFindManyByRoomIdParams{
+				RoomId: roomId,
+				Before: before,
+				Limit:  limit,
+			},
+		)
+		if err != nil {
+			slog.Error("error finding room messages", "roomId", roomId)
+			errorToJSON(w, http.StatusInternalServerError, err)
+			return
+		}
+		var nextCursor *uuid.UUID
+		if len(messages) == limit {
+			nextCursor = &messages[0].MessageId
+		}
 		writeJSON(w, http.StatusOK, baseResponse{
 			Success: true,
-			Message: "room joined",
+			Message: "messages found",
+			Data: map[string]any{
+				"messages":   messages,
+				"nextCursor": nextCursor,
+			},
 		})
 	})
 
@@ -254,6 +1047,19 @@ func (router *Router) apiAuthedRouteGroup(mux chi.Router) {
 			errorToJSON(w, http.StatusBadRequest, err)
 			return
 		}
+		room, err := router.Repository.RoomFindOne(
+			r.Context(),
+			repository.RoomFindOneParams{RoomId: roomId},
+		)
+		if err != nil {
+			slog.Error("error finding room", "roomId", roomId)
+			errorToJSON(w, http.StatusNotFound, chat.RoomNotFoundError)
+			return
+		}
+		if room.Kind == repository.ROOM_KIND_DIRECT {
+			errorToJSON(w, http.StatusForbidden, directRoomError)
+			return
+		}
 		err = router.Repository.UserLeaveRoom(
 			r.Context(),
 			repository.UserLeaveRoomParams{
@@ -272,4 +1078,183 @@ func (router *Router) apiAuthedRouteGroup(mux chi.Router) {
 			Message: "room left",
 		})
 	})
+
+	mux.Post("/messages/edit", func(w http.ResponseWriter, r *http.Request) {
+		session := sessionFromContextSafe(r.Context())
+		body, err := readJSON[struct {
+			MessageId string `json:"messageId"`
+			Body      string `json:"body"`
+		}](r)
+		if err != nil {
+			slog.Error("error parsing body")
+			errorToJSON(w, http.StatusBadRequest, err)
+			return
+		}
+		messageId, err := uuid.FromString(body.MessageId)
+		if err != nil {
+			slog.Error("error parsing messageId", "body.MessageId", body.MessageId)
+			errorToJSON(w, http.StatusBadRequest, err)
+			return
+		}
+		err = router.ChatService.MessageEdit(session.UserId, messageId, body.Body)
+		if err != nil {
+			slog.Error("error editing message", "messageId", messageId)
+			errorToJSON(w, chatErrorStatus(err), err)
+			return
+		}
+		writeJSON(w, http.StatusOK, baseResponse{
+			Success: true,
+			Message: "message edited",
+		})
+	})
+
+	mux.Post("/messages/delete", func(w http.ResponseWriter, r *http.Request) {
+		session := sessionFromContextSafe(r.Context())
+		body, err := readJSON[struct {
+			MessageId string `json:"messageId"`
+		}](r)
+		if err != nil {
+			slog.Error("error parsing body")
+			errorToJSON(w, http.StatusBadRequest, err)
+			return
+		}
+		messageId, err := uuid.FromString(body.MessageId)
+		if err != nil {
+			slog.Error("error parsing messageId", "body.MessageId", body.MessageId)
+			errorToJSON(w, http.StatusBadRequest, err)
+			return
+		}
+		err = router.ChatService.MessageDelete(session.UserId, messageId)
+		if err != nil {
+			slog.Error("error deleting message", "messageId", messageId)
+			errorToJSON(w, chatErrorStatus(err), err)
+			return
+		}
+		writeJSON(w, http.StatusOK, baseResponse{
+			Success: true,
+			Message: "message deleted",
+		})
+	})
+
+	mux.Get("/messages/{messageId}/thread", func(w http.ResponseWriter, r *http.Request) {
+		session := sessionFromContextSafe(r.Context())
+		messageId, err := uuid.FromString(chi.URLParam(r, "messageId"))
+		if err != nil {
+			slog.Error(
+				"error parsing messageId",
+				"messageId", chi.URLParam(r, "messageId"),
+			)
+			errorToJSON(w, http.StatusBadRequest, err)
+			return
+		}
+		parent, err := router.Repository.MessageFindOne(
+			r.Context(),
+			repository.MessageFindOneParams{MessageId: messageId},
+		)
+		if err != nil {
+			slog.Error("error finding message", "messageId", messageId)
+			errorToJSON(w, http.StatusNotFound, chat.MessageNotFoundError)
+			return
+		}
+		if parent.ParentId != nil {
+			parent, err = router.Repository.MessageFindOne(
+				r.Context(),
+				repository.MessageFindOneParams{MessageId: *parent.ParentId},
+			)
+			if err != nil {
+				slog.Error("error finding thread root", "messageId", messageId)
+				errorToJSON(w, http.StatusNotFound, chat.MessageNotFoundError)
+				return
+			}
+		}
+		isMember, err := router.Repository.UserCheckRoomMembership(
+			r.Context(),
+			repository.UserCheckRoomMembershipParams{
+				UserId: session.UserId,
+				RoomId: parent.RoomId,
+			},
+		)
+		if err != nil {
+			slog.Error("error checking room membership", "roomId", parent.RoomId)
+			errorToJSON(w, http.StatusInternalServerError, err)
+			return
+		}
+		if !isMember {
+			errorToJSON(w, http.StatusForbidden, chat.NotRoomMemberError)
+			return
+		}
+		replies, err := router.Repository.MessagesFindManyByParentId(
+			r.Context(),
+			repository.MessagesFindManyByParentIdParams{
+				ParentId: parent.MessageId,
+			},
+		)
+		if err != nil {
+			slog.Error("error finding replies", "messageId", parent.MessageId)
+			errorToJSON(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, baseResponse{
+			Success: true,
+			Message: "thread found",
+			Data: map[string]any{
+				"parent":  parent,
+				"replies": replies,
+			},
+		})
+	})
+
+	mux.Get("/messages/{messageId}/seen", func(w http.ResponseWriter, r *http.Request) {
+		session := sessionFromContextSafe(r.Context())
+		messageId, err := uuid.FromString(chi.URLParam(r, "messageId"))
+		if err != nil {
+			slog.Error(
+				"error parsing messageId",
+				"messageId", chi.URLParam(r, "messageId"),
+			)
+			errorToJSON(w, http.StatusBadRequest, err)
+			return
+		}
+		message, err := router.Repository.MessageFindOne(
+			r.Context(),
+			repository.MessageFindOneParams{MessageId: messageId},
+		)
+		if err != nil {
+			slog.Error("error finding message", "messageId", messageId)
+			errorToJSON(w, http.StatusNotFound, chat.MessageNotFoundError)
+			return
+		}
+		isMember, err := router.Repository.UserCheckRoomMembership(
+			r.Context(),
+			repository.UserCheckRoomMembershipParams{
+				UserId: session.UserId,
+				RoomId: message.RoomId,
+			},
+		)
+		if err != nil {
+			slog.Error("error checking room membership", "roomId", message.RoomId)
+			errorToJSON(w, http.StatusInternalServerError, err)
+			return
+		}
+		if !isMember {
+			errorToJSON(w, http.StatusForbidden, chat.NotRoomMemberError)
+			return
+		}
+		seenBy, err := router.Repository.MessageSeenByFindMany(
+			r.Context(),
+			repository.MessageSeenByFindManyParams{MessageId: messageId},
+		)
+		if err != nil {
+			slog.Error("error finding seen by", "messageId", messageId)
+			errorToJSON(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, baseResponse{
+			Success: true,
+			Message: "seen by found",
+			Data: map[string]any{
+				"seenBy": seenBy,
+			},
+		})
+	})
 }
@@ -1,7 +1,38 @@
 package router
 
+import "time"
+
 type UserContextKey string
 
 const USER_SESSION_CONTEXT_KEY UserContextKey = "USER_SESSION"
 
 const SESSION_ID_COOKIE = "sessionId"
+
+const MESSAGES_PAGE_LIMIT = 50
+
+const MESSAGES_PAGE_LIMIT_MAX = 100
+
+const DIRECTORY_PAGE_LIMIT = 25
+
+const DIRECTORY_PAGE_LIMIT_MAX = 100
+
+const SEARCH_PAGE_LIMIT = 25
+
+const SEARCH_PAGE_LIMIT_MAX = 100
+
+const SEARCH_DATE_LAYOUT = "2006-01-02"
+
+// identifies a page load's socket, unlike the chat package's message client
+// IDs
+const MAX_CONNECTION_CLIENT_ID_LENGTH = 64
+
+// login and signup attempts per client address, one more every interval up
+// to the burst
+const AUTH_RATE_INTERVAL = 12 * time.Second
+
+const AUTH_RATE_BURST = 10
+
+// attempts refused before an address is locked out
+const AUTH_MUTE_AFTER = 10
+
+const AUTH_MUTE_DURATION = 15 * time.Minute
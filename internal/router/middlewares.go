@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"gossip/internal/repository"
 	"log/slog"
+	"math"
 	"net/http"
+	"strconv"
 
 	"github.com/gofrs/uuid/v5"
 )
@@ -66,3 +68,21 @@ func (router *Router) apiAuthMiddleware(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// guards against brute force by limiting attempts per client address
+func (router *Router) authRateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := router.clientIP(r)
+		result := router.authLimiter.Allow(ip)
+		if !result.Allowed {
+			slog.Error("too many auth attempts", "ip", ip, "muted", result.Muted)
+			w.Header().Set(
+				"retry-after",
+				strconv.Itoa(int(math.Ceil(result.RetryAfter.Seconds()))),
+			)
+			errorToJSON(w, http.StatusTooManyRequests, tooManyRequestsError)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
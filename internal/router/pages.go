@@ -73,6 +73,20 @@ func (router *Router) pagesAuthedRouteGroup(mux chi.Router) {
 			)
 			return
 		}
+		directRooms, err := router.Repository.DirectRoomsFindManyByUserId(
+			r.Context(),
+			repository.DirectRoomsFindManyByUserIdParams{
+				UserId: session.UserId,
+			},
+		)
+		if err != nil {
+			slog.Error(
+				"error finding direct rooms for user",
+				"userSession",
+				session,
+			)
+			return
+		}
 		t, err := template.ParseFiles("pages/home.html")
 		if err != nil {
 			slog.Error("error parsing home.html", "error", err)
@@ -80,8 +94,9 @@ func (router *Router) pagesAuthedRouteGroup(mux chi.Router) {
 			return
 		}
 		if err := t.Execute(w, map[string]any{
-			"username": session.Username,
-			"rooms":    rooms,
+			"username":    session.Username,
+			"rooms":       rooms,
+			"directRooms": directRooms,
 		}); err != nil {
 			slog.Error("error executing home.html template", "error", err)
 			w.WriteHeader(http.StatusInternalServerError)
@@ -110,6 +125,58 @@ func (router *Router) pagesAuthedRouteGroup(mux chi.Router) {
 		}
 	})
 
+	mux.Get("/search", func(w http.ResponseWriter, r *http.Request) {
+		session := sessionFromContextSafe(r.Context())
+		rooms, err := router.Repository.RoomFindManyByUserId(
+			r.Context(),
+			repository.RoomFindManyByUserIdParams{UserId: session.UserId},
+		)
+		if err != nil {
+			slog.Error("error finding rooms for user", "userId", session.UserId)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		t, err := template.ParseFiles("pages/search.html")
+		if err != nil {
+			slog.Error("error parsing search.html", "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if err := t.Execute(w, map[string]any{
+			"username": session.Username,
+			"rooms":    rooms,
+		}); err != nil {
+			slog.Error(
+				"error executing search.html template",
+				"error",
+				err,
+			)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	})
+
+	mux.Get("/rooms/directory", func(w http.ResponseWriter, r *http.Request) {
+		session := sessionFromContextSafe(r.Context())
+		t, err := template.ParseFiles("pages/directory.html")
+		if err != nil {
+			slog.Error("error parsing directory.html", "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if err := t.Execute(w, map[string]any{
+			"username": session.Username,
+		}); err != nil {
+			slog.Error(
+				"error executing directory.html template",
+				"error",
+				err,
+			)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	})
+
 	mux.Get("/rooms/join", func(w http.ResponseWriter, r *http.Request) {
 		session := sessionFromContextSafe(r.Context())
 		t, err := template.ParseFiles("pages/join-room.html")
@@ -120,6 +187,7 @@ func (router *Router) pagesAuthedRouteGroup(mux chi.Router) {
 		}
 		if err := t.Execute(w, map[string]any{
 			"username": session.Username,
+			"inviteId": r.URL.Query().Get("invite"),
 		}); err != nil {
 			slog.Error(
 				"error executing join-room.html template",
@@ -171,9 +239,44 @@ func (router *Router) pagesAuthedRouteGroup(mux chi.Router) {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
+		roomName := room.Name
+		isDirect := room.Kind == repository.ROOM_KIND_DIRECT
+		if isDirect {
+			members, err := router.Repository.UsersFindManyByRoomId(
+				r.Context(),
+				repository.UsersFindManyByRoomIdParams{RoomId: roomId},
+			)
+			if err != nil {
+				slog.Error("error finding room members", "roomId", roomId)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			for _, member := range members {
+				if member.UserId != session.UserId {
+					roomName = member.Username
+				}
+			}
+		}
+		role, err := router.Repository.RoomUserRoleFindOne(
+			r.Context(),
+			repository.RoomUserRoleFindOneParams{
+				UserId: session.UserId,
+				RoomId: roomId,
+			},
+		)
+		if err != nil {
+			slog.Error("error finding room role", "roomId", roomId)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		canManage := !isDirect &&
+			roomRoleRank(role.Role) >= roomRoleRank(repository.ROOM_ROLE_ADMIN)
 		messages, err := router.Repository.MessagesFindManyByRoomId(
 			r.Context(),
-			repository.MessagesFindManyByRoomIdParams{RoomId: roomId},
+			repository.MessagesFindManyByRoomIdParams{
+				RoomId: roomId,
+				Limit:  MESSAGES_PAGE_LIMIT,
+			},
 		)
 		if err != nil {
 			slog.Error("error room messages", "roomId", roomId)
@@ -185,9 +288,14 @@ func (router *Router) pagesAuthedRouteGroup(mux chi.Router) {
 			return
 		}
 		err = t.Execute(w, map[string]any{
-			"username": session.Username,
-			"roomName": room.Name,
-			"messages": messages,
+			"userId":     session.UserId.String(),
+			"username":   session.Username,
+			"roomName":   roomName,
+			"isDirect":   isDirect,
+			"canManage":  canManage,
+			"visibility": room.Visibility,
+			"messages":   messages,
+			"hasMore":    len(messages) == MESSAGES_PAGE_LIMIT,
 		})
 		if err != nil {
 			slog.Error("error executing room.html template", "error", err)
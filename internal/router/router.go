@@ -3,18 +3,27 @@ package router
 import (
 	"gossip/internal/chat"
 	"gossip/internal/repository"
+	"gossip/internal/utils/ratelimit"
 	"net/http"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 )
 
+// zero auth rate fields fall back to the defaults in constants.go; the client
+// IP header is trusted to carry the client's address when set, so it must
+// only be set behind a proxy that overwrites it
 type Router struct {
-	Repository  *repository.Repository
-	ChatService *chat.Service
+	Repository     *repository.Repository
+	ChatService    *chat.Service
+	AuthRate       ratelimit.Params
+	ClientIPHeader string
+	authLimiter    *ratelimit.Limiter
 }
 
 func (router *Router) Init() (*chi.Mux, error) {
+	router.authLimiter = ratelimit.New(router.authRate())
+
 	mux := chi.NewMux()
 
 	mux.Use(middleware.Logger)
@@ -35,3 +44,22 @@ func (router *Router) Init() (*chi.Mux, error) {
 
 	return mux, nil
 }
+
+// zero values fall back to the defaults, a negative interval turns the limit
+// off
+func (router *Router) authRate() ratelimit.Params {
+	params := router.AuthRate
+	if params.Interval == 0 {
+		params.Interval = AUTH_RATE_INTERVAL
+	}
+	if params.Burst <= 0 {
+		params.Burst = AUTH_RATE_BURST
+	}
+	if params.MuteAfter <= 0 {
+		params.MuteAfter = AUTH_MUTE_AFTER
+	}
+	if params.MuteDuration <= 0 {
+		params.MuteDuration = AUTH_MUTE_DURATION
+	}
+	return params
+}
@@ -4,11 +4,17 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"gossip/internal/chat"
 	"gossip/internal/repository"
 	"log"
 	"log/slog"
+	"net"
 	"net/http"
 	"strings"
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/jackc/pgx/v5"
 )
 
 func walkRoutes(
@@ -24,6 +30,51 @@ func walkRoutes(
 
 var invalidSessionError = errors.New("invalid session")
 
+var invalidLimitError = errors.New("invalid limit")
+
+var userNotFoundError = errors.New("user not found")
+
+var directRoomError = errors.New("direct rooms cannot be joined or left")
+
+var directRoomSelfError = errors.New("cannot open a direct room with yourself")
+
+var emptyRoomNameError = errors.New("room name is empty")
+
+var invalidRoomRoleError = errors.New("invalid room role")
+
+var insufficientRoomRoleError = errors.New("insufficient room role")
+
+var invalidRoomVisibilityError = errors.New("invalid room visibility")
+
+var invalidInviteOptionsError = errors.New("invite expiry and max uses must be positive")
+
+var joinRequestNotFoundError = errors.New("join request not found")
+
+var emptySearchQueryError = errors.New("search query is empty")
+
+var invalidSearchDateError = errors.New("invalid search date")
+
+var invalidOffsetError = errors.New("invalid offset")
+
+var clientIdTooLongError = errors.New("connection client ID too long")
+
+var tooManyRequestsError = errors.New("too many attempts, try again later")
+
+// the address the request came from, read from the client IP header when
+// behind a proxy that sets it
+func (router *Router) clientIP(r *http.Request) string {
+	if router.ClientIPHeader != "" {
+		if ip := r.Header.Get(router.ClientIPHeader); ip != "" {
+			return ip
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
 func sessionFromContext(
 	ctx context.Context,
 ) (repository.SessionFindOneResult, error) {
@@ -71,3 +122,122 @@ func errorToJSON(w http.ResponseWriter, status int, err error) {
 		slog.Error("error writing JSON body", "error", encodingErr.Error())
 	}
 }
+
+func chatErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, chat.RoomNotFoundError),
+		errors.Is(err, chat.MessageNotFoundError):
+		return http.StatusNotFound
+	case errors.Is(err, chat.NotMessageAuthorError),
+		errors.Is(err, chat.NotRoomMemberError):
+		return http.StatusForbidden
+	case errors.Is(err, chat.EmptyMessageError):
+		return http.StatusBadRequest
+	case errors.Is(err, chat.ShuttingDownError):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func roomRoleRank(role string) int {
+	switch role {
+	case repository.ROOM_ROLE_OWNER:
+		return 3
+	case repository.ROOM_ROLE_ADMIN:
+		return 2
+	case repository.ROOM_ROLE_MEMBER:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// writes an error response and returns false unless the user is an owner or
+// admin of the group room
+func (router *Router) authorizeRoomManager(
+	w http.ResponseWriter,
+	r *http.Request,
+	userId uuid.UUID,
+	roomId uuid.UUID,
+) (string, bool) {
+	room, err := router.Repository.RoomFindOne(
+		r.Context(),
+		repository.RoomFindOneParams{RoomId: roomId},
+	)
+	if err != nil {
+		slog.Error("error finding room", "roomId", roomId)
+		errorToJSON(w, http.StatusNotFound, chat.RoomNotFoundError)
+		return "", false
+	}
+	if room.Kind == repository.ROOM_KIND_DIRECT {
+		errorToJSON(w, http.StatusForbidden, directRoomError)
+		return "", false
+	}
+	result, err := router.Repository.RoomUserRoleFindOne(
+		r.Context(),
+		repository.RoomUserRoleFindOneParams{
+			UserId: userId,
+			RoomId: roomId,
+		},
+	)
+	if err != nil {
+		slog.Error("error finding room role", "userId", userId, "roomId", roomId)
+		errorToJSON(w, http.StatusForbidden, chat.NotRoomMemberError)
+		return "", false
+	}
+	if roomRoleRank(result.Role) < roomRoleRank(repository.ROOM_ROLE_ADMIN) {
+		errorToJSON(w, http.StatusForbidden, insufficientRoomRoleError)
+		return "", false
+	}
+	return result.Role, true
+}
+
+func isRoomVisibility(visibility string) bool {
+	switch visibility {
+	case repository.ROOM_VISIBILITY_PUBLIC,
+		repository.ROOM_VISIBILITY_INVITE,
+		repository.ROOM_VISIBILITY_REQUEST:
+		return true
+	default:
+		return false
+	}
+}
+
+func joinError(err error) error {
+	if errors.Is(err, pgx.ErrNoRows) {
+		return chat.RoomNotFoundError
+	}
+	return err
+}
+
+func joinErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, pgx.ErrNoRows),
+		errors.Is(err, repository.InvalidInviteError):
+		return http.StatusNotFound
+	case errors.Is(err, repository.InviteRequiredError):
+		return http.StatusForbidden
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// parses an RFC 3339 timestamp or a plain date; a plain date used as an
+// exclusive upper bound is moved to the end of that day
+func parseSearchTime(value string, upper bool) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return &t, nil
+	}
+	t, err := time.Parse(SEARCH_DATE_LAYOUT, value)
+	if err != nil {
+		return nil, invalidSearchDateError
+	}
+	if upper {
+		t = t.AddDate(0, 0, 1)
+	}
+	return &t, nil
+}
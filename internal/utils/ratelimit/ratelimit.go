@@ -0,0 +1,112 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// one token is added to a key's bucket every interval, up to burst tokens,
+// a zero or negative interval never limits; a key refused mute after times
+// before its bucket fills back up is refused everything for the mute
+// duration, a zero mute after never mutes
+type Params struct {
+	Interval     time.Duration
+	Burst        int
+	MuteAfter    int
+	MuteDuration time.Duration
+}
+
+type Result struct {
+	Allowed bool
+	Muted   bool
+	// until a request for the key would be allowed, zero when allowed
+	RetryAfter time.Duration
+}
+
+// token buckets keyed by user, room, address or whatever else is limited
+type Limiter struct {
+	params   Params
+	mu       sync.Mutex
+	buckets  map[string]*bucket
+	prunedAt time.Time
+	now      func() time.Time
+}
+
+type bucket struct {
+	tokens float64
+	// refused requests since the bucket was last full
+	strikes    int
+	updatedAt  time.Time
+	mutedUntil time.Time
+}
+
+func New(params Params) *Limiter {
+	if params.Burst < 1 {
+		params.Burst = 1
+	}
+	return &Limiter{
+		params:  params,
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+// takes a token from the key's bucket if there is one
+func (limiter *Limiter) Allow(key string) Result {
+	if limiter.params.Interval <= 0 {
+		return Result{Allowed: true}
+	}
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	now := limiter.now()
+	limiter.prune(now)
+	b, ok := limiter.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limiter.params.Burst), updatedAt: now}
+		limiter.buckets[key] = b
+	}
+	limiter.refill(b, now)
+	if now.Before(b.mutedUntil) {
+		return Result{Muted: true, RetryAfter: b.mutedUntil.Sub(now)}
+	}
+	if b.tokens >= 1 {
+		b.tokens--
+		return Result{Allowed: true}
+	}
+	b.strikes++
+	if limiter.params.MuteAfter > 0 &&
+		b.strikes >= limiter.params.MuteAfter {
+		b.strikes = 0
+		b.mutedUntil = now.Add(limiter.params.MuteDuration)
+		return Result{Muted: true, RetryAfter: limiter.params.MuteDuration}
+	}
+	return Result{
+		RetryAfter: time.Duration((1 - b.tokens) * float64(limiter.params.Interval)),
+	}
+}
+
+func (limiter *Limiter) refill(b *bucket, now time.Time) {
+	earned := float64(now.Sub(b.updatedAt)) / float64(limiter.params.Interval)
+	b.tokens = min(b.tokens+earned, float64(limiter.params.Burst))
+	if b.tokens == float64(limiter.params.Burst) {
+		b.strikes = 0
+	}
+	b.updatedAt = now
+}
+
+// forgets keys that are back where they started, at most once per the time
+// it takes an empty bucket to fill
+func (limiter *Limiter) prune(now time.Time) {
+	period := limiter.params.Interval * time.Duration(limiter.params.Burst)
+	if now.Sub(limiter.prunedAt) < period {
+		return
+	}
+	limiter.prunedAt = now
+	for key, b := range limiter.buckets {
+		limiter.refill(b, now)
+		if b.tokens == float64(limiter.params.Burst) &&
+			!now.Before(b.mutedUntil) {
+			delete(limiter.buckets, key)
+		}
+	}
+}
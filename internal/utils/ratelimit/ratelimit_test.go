@@ -0,0 +1,67 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	now := time.Now()
+	limiter := New(Params{
+		Interval:     time.Second,
+		Burst:        2,
+		MuteAfter:    3,
+		MuteDuration: time.Minute,
+	})
+	limiter.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if !limiter.Allow("a").Allowed {
+			t.Fatal("refused within burst", i)
+		}
+	}
+	result := limiter.Allow("a")
+	if result.Allowed || result.Muted || result.RetryAfter != time.Second {
+		t.Fatal("failed to throttle past burst", result)
+	}
+	if !limiter.Allow("b").Allowed {
+		t.Fatal("throttled an unrelated key")
+	}
+
+	now = now.Add(time.Second)
+	if !limiter.Allow("a").Allowed {
+		t.Fatal("failed to refill")
+	}
+
+	limiter.Allow("a")
+	result = limiter.Allow("a")
+	if !result.Muted || result.RetryAfter != time.Minute {
+		t.Fatal("failed to mute a repeat offender", result)
+	}
+	now = now.Add(30 * time.Second)
+	if result := limiter.Allow("a"); !result.Muted {
+		t.Fatal("unmuted early", result)
+	}
+	now = now.Add(30 * time.Second)
+	if !limiter.Allow("a").Allowed {
+		t.Fatal("failed to unmute")
+	}
+
+	now = now.Add(time.Hour)
+	limiter.Allow("c")
+	if _, ok := limiter.buckets["b"]; ok {
+		t.Fatal("failed to prune an idle key")
+	}
+}
+
+func TestLimiterUnlimited(t *testing.T) {
+	limiter := New(Params{Burst: 1})
+	for i := 0; i < 3; i++ {
+		if !limiter.Allow("a").Allowed {
+			t.Fatal("limited with a zero interval", i)
+		}
+	}
+	if len(limiter.buckets) != 0 {
+		t.Fatal("kept buckets with a zero interval")
+	}
+}
@@ -0,0 +1,4 @@
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS client_id VARCHAR(255);
+
+CREATE UNIQUE INDEX IF NOT EXISTS messages_user_id_client_id_idx
+    ON messages (user_id, client_id);
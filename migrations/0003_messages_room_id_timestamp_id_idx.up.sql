@@ -0,0 +1,2 @@
+CREATE INDEX IF NOT EXISTS messages_room_id_timestamp_id_idx
+    ON messages (room_id, timestamp, id);
@@ -0,0 +1,7 @@
+ALTER TABLE rooms ADD COLUMN IF NOT EXISTS kind VARCHAR(16) NOT NULL DEFAULT 'group';
+
+-- direct rooms are named after their members, so names only need to be unique
+-- within a kind
+ALTER TABLE rooms DROP CONSTRAINT IF EXISTS rooms_name_key;
+
+CREATE UNIQUE INDEX IF NOT EXISTS rooms_kind_name_idx ON rooms (kind, name);
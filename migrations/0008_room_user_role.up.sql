@@ -0,0 +1 @@
+ALTER TABLE room_users ADD COLUMN IF NOT EXISTS role VARCHAR(16) NOT NULL DEFAULT 'member';
@@ -0,0 +1,3 @@
+CREATE INDEX IF NOT EXISTS rooms_kind_visibility_name_idx ON rooms (kind, visibility, name);
+
+CREATE INDEX IF NOT EXISTS rooms_name_tsv_idx ON rooms USING GIN (to_tsvector('simple', name));
@@ -0,0 +1,4 @@
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS body_tsv TSVECTOR
+    GENERATED ALWAYS AS (to_tsvector('english', COALESCE(body, ''))) STORED;
+
+CREATE INDEX IF NOT EXISTS messages_body_tsv_idx ON messages USING GIN (body_tsv);
@@ -0,0 +1,15 @@
+ALTER TABLE room_users ADD COLUMN IF NOT EXISTS last_read_message_id UUID
+    REFERENCES messages(id) ON DELETE SET NULL;
+
+-- existing members start with everything read instead of a full backlog
+UPDATE room_users
+SET
+    last_read_message_id = (
+        SELECT id
+        FROM messages
+        WHERE messages.room_id = room_users.room_id
+        ORDER BY timestamp DESC, id DESC
+        LIMIT 1
+    )
+WHERE
+    last_read_message_id IS NULL;
@@ -0,0 +1,6 @@
+-- a client ID reused in another room saves a new message there instead of
+-- acking the one saved in the first room
+CREATE UNIQUE INDEX IF NOT EXISTS messages_user_id_room_id_client_id_idx
+    ON messages (user_id, room_id, client_id);
+
+DROP INDEX IF EXISTS messages_user_id_client_id_idx;
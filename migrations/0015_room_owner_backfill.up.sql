@@ -0,0 +1,35 @@
+-- group rooms created before roles existed have no owner; the member who
+-- posted first, failing that any member, is made the owner of each
+WITH first_members AS (
+    SELECT DISTINCT ON (room_users.room_id)
+        room_users.room_id,
+        room_users.user_id
+    FROM room_users
+    JOIN rooms ON rooms.id = room_users.room_id
+    WHERE
+        rooms.kind = 'group'
+        AND NOT EXISTS (
+            SELECT 1
+            FROM room_users AS owners
+            WHERE
+                owners.room_id = room_users.room_id
+                AND owners.role = 'owner'
+        )
+    ORDER BY
+        room_users.room_id,
+        (
+            SELECT MIN(timestamp)
+            FROM messages
+            WHERE
+                messages.room_id = room_users.room_id
+                AND messages.user_id = room_users.user_id
+        ) ASC NULLS LAST,
+        room_users.user_id ASC
+)
+UPDATE room_users
+SET
+    role = 'owner'
+FROM first_members
+WHERE
+    room_users.room_id = first_members.room_id
+    AND room_users.user_id = first_members.user_id;
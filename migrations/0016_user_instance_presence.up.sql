@@ -0,0 +1,10 @@
+-- the presence of a user's connections on each server instance, so that a
+-- user only goes offline once no instance holds a connection; rows of an
+-- instance that stops refreshing them are ignored once stale
+CREATE TABLE IF NOT EXISTS user_instance_presences (
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    instance_id UUID NOT NULL,
+    presence VARCHAR(16) NOT NULL,
+    seen_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, instance_id)
+);
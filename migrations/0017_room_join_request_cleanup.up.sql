@@ -0,0 +1,10 @@
+-- requests left queued by users who joined some other way, through an invite
+-- or after the room became public
+DELETE FROM room_join_requests
+WHERE EXISTS (
+    SELECT 1
+    FROM room_users
+    WHERE
+        room_users.room_id = room_join_requests.room_id
+        AND room_users.user_id = room_join_requests.user_id
+);
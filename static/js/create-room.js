@@ -9,8 +9,9 @@ createRoomForm.onsubmit = async (event) => {
     event.preventDefault();
     const formData = new FormData(createRoomForm);
     const roomName = formData.get("room-name");
+    const visibility = formData.get("visibility");
     try {
-        await createRoom(roomName);
+        await createRoom(roomName, visibility);
     } catch {
         alert("Error creating room");
         return;
@@ -20,8 +21,9 @@ createRoomForm.onsubmit = async (event) => {
 
 /**
  * @param {string} roomName
+ * @param {string} visibility
  */
-async function createRoom(roomName) {
+async function createRoom(roomName, visibility) {
     await fetch("/api/rooms/create", {
         method: "POST",
         headers: {
@@ -29,6 +31,7 @@ async function createRoom(roomName) {
         },
         body: JSON.stringify({
             roomName: roomName,
+            visibility: visibility,
         }),
     });
 }
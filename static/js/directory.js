@@ -0,0 +1,122 @@
+"use strict";
+
+/**
+ * @typedef {Object} DirectoryRoom
+ * @property {string} roomId
+ * @property {string} name
+ * @property {string} visibility
+ * @property {number} memberCount
+ * @property {string | null} lastActivity
+ * @property {boolean} isMember
+ */
+
+import { registerLogoutButton } from "./functions.js";
+
+registerLogoutButton();
+
+const directoryRooms = document.getElementById("directory-rooms");
+const directoryEmpty = document.getElementById("directory-empty");
+const directoryMore = document.getElementById("directory-more");
+const directoryRoomTemplate = document.getElementById(
+    "directory-room-template",
+);
+
+/** @type {string} */
+let query = "";
+
+/** @type {string | null} */
+let nextCursor = null;
+
+const directorySearch = document.getElementById("directory-search");
+directorySearch.onsubmit = async (event) => {
+    event.preventDefault();
+    const formData = new FormData(directorySearch);
+    query = formData.get("q").trim();
+    nextCursor = null;
+    directoryRooms.replaceChildren();
+    await loadRooms();
+};
+
+directoryMore.onclick = async (event) => {
+    event.preventDefault();
+    await loadRooms();
+};
+
+loadRooms();
+
+async function loadRooms() {
+    const url = new URL("/api/rooms/directory", window.location.origin);
+    if (query) {
+        url.searchParams.set("q", query);
+    }
+    if (nextCursor) {
+        url.searchParams.set("after", nextCursor);
+    }
+    const res = await fetch(url);
+    const body = await res.json();
+    if (!res.ok) {
+        console.error("error loading directory", body);
+        return;
+    }
+    for (const room of body.data.rooms) {
+        renderRoom(room);
+    }
+    nextCursor = body.data.nextCursor;
+    directoryMore.hidden = !nextCursor;
+    directoryEmpty.hidden = directoryRooms.childElementCount > 0;
+}
+
+/**
+ * @param {DirectoryRoom} room
+ */
+function renderRoom(room) {
+    const element = directoryRoomTemplate.content.cloneNode(true);
+    element.querySelector("[data-room-name]").textContent = room.name;
+    const members = `${room.memberCount} ${room.memberCount === 1 ? "member" : "members"}`;
+    const activity = room.lastActivity
+        ? `active ${new Date(room.lastActivity).toLocaleString()}`
+        : "no messages yet";
+    element.querySelector("[data-room-details]").textContent =
+        `${members} · ${activity}`;
+    const action = element.querySelector("[data-room-action]");
+    if (room.isMember) {
+        action.textContent = "Open";
+        action.onclick = () => {
+            window.location.assign(`/rooms/${room.roomId}`);
+        };
+    } else {
+        action.textContent =
+            room.visibility === "request" ? "Request to Join" : "Join";
+        action.onclick = async () => {
+            await joinRoom(room, action);
+        };
+    }
+    directoryRooms.appendChild(element);
+}
+
+/**
+ * @param {DirectoryRoom} room
+ * @param {HTMLButtonElement} action
+ */
+async function joinRoom(room, action) {
+    const res = await fetch("/api/rooms/join", {
+        method: "POST",
+        headers: {
+            "content-type": "application/json",
+        },
+        body: JSON.stringify({
+            roomId: room.roomId,
+        }),
+    });
+    const body = await res.json();
+    if (!res.ok) {
+        alert(body.message);
+        return;
+    }
+    if (body.data.status === "requested") {
+        action.textContent = "Requested";
+        action.disabled = true;
+        return;
+    }
+    window.location.assign(`/rooms/${room.roomId}`);
+}
@@ -1,3 +1,12 @@
+// close codes sent by the server after which reconnecting is pointless
+export const CLOSE_LOGGED_OUT = 4001;
+export const CLOSE_KICKED = 4002;
+export const CLOSE_REPLACED = 4003;
+
+// identifies this page load, so that reconnecting replaces the old socket
+// rather than leaving it to time out
+export const CLIENT_ID = crypto.randomUUID();
+
 export function registerLogoutButton() {
     const logoutButton = document.getElementById("logout-button");
     logoutButton.onclick = async (event) => {
@@ -1,5 +1,105 @@
 "use strict";
 
-import { registerLogoutButton } from "./functions.js";
+/**
+ * @typedef {Object} Frame
+ * @property {number} v
+ * @property {string} type
+ * @property {string} [id]
+ * @property {any} payload
+ */
+
+import {
+    CLIENT_ID,
+    CLOSE_LOGGED_OUT,
+    CLOSE_REPLACED,
+    registerLogoutButton,
+} from "./functions.js";
 
 registerLogoutButton();
+
+const openDMForm = document.getElementById("open-dm-form");
+openDMForm.onsubmit = async (event) => {
+    event.preventDefault();
+    const formData = new FormData(openDMForm);
+    const username = formData.get("username");
+    let roomId;
+    try {
+        roomId = await openDM(username);
+    } catch {
+        alert("Error opening direct message");
+        return;
+    }
+    window.location.assign(`/rooms/${roomId}`);
+};
+
+/**
+ * @param {string} username
+ * @returns {Promise<string>} the direct room ID
+ */
+async function openDM(username) {
+    const res = await fetch("/api/dms/open", {
+        method: "POST",
+        headers: {
+            "content-type": "application/json",
+        },
+        body: JSON.stringify({
+            username: username,
+        }),
+    });
+    const json = await res.json();
+    if (!json.success) {
+        throw new Error(json.message);
+    }
+    return json.data.room.id;
+}
+
+const RECONNECT_WAIT = 2000;
+
+connect();
+
+// no cursors are sent, so the connection only hears about activity in our
+// rooms rather than receiving their messages
+function connect() {
+    let scheme = "ws";
+    if (document.location.protocol === "https:") {
+        scheme += "s";
+    }
+    const ws = new WebSocket(
+        `${scheme}://${document.location.hostname}:${document.location.port}/api/connect?client=${CLIENT_ID}`,
+    );
+    ws.onmessage = (event) => {
+        /** @type Frame */
+        const frame = JSON.parse(event.data);
+        switch (frame.type) {
+            case "room.activity":
+                bumpUnread(frame.payload.roomId);
+                break;
+            case "room.deleted":
+            case "room.renamed":
+                window.location.reload();
+                break;
+        }
+    };
+    ws.onclose = (event) => {
+        if (event.code === CLOSE_REPLACED) {
+            return;
+        }
+        if (event.code === CLOSE_LOGGED_OUT) {
+            window.location.replace("/");
+            return;
+        }
+        setTimeout(connect, RECONNECT_WAIT);
+    };
+}
+
+/**
+ * @param {string} roomId
+ */
+function bumpUnread(roomId) {
+    const badge = document.querySelector(`[data-unread-room-id="${roomId}"]`);
+    if (!badge) {
+        return;
+    }
+    badge.textContent = Number(badge.textContent.trim()) + 1;
+    badge.hidden = false;
+}
@@ -9,26 +9,54 @@ joinRoomForm.onsubmit = async (event) => {
     event.preventDefault();
     const formData = new FormData(joinRoomForm);
     const roomId = formData.get("room-id");
+    const inviteId = parseInvite(formData.get("invite"));
+    let res;
     try {
-        await joinRoom(roomId);
+        res = await joinRoom(roomId, inviteId);
     } catch {
-        alert("Error creating room");
+        alert("Error joining room");
         return;
     }
-    window.location.replace("/home");
+    if (!res.success) {
+        alert(res.message);
+        return;
+    }
+    if (res.data.status === "requested") {
+        alert("Join request sent, an admin will review it");
+        window.location.replace("/home");
+        return;
+    }
+    window.location.replace(`/rooms/${res.data.roomId}`);
 };
 
+/**
+ * accepts either a full invite link or the bare invite ID
+ *
+ * @param {string} invite
+ * @returns {string}
+ */
+function parseInvite(invite) {
+    invite = invite.trim();
+    if (!invite.includes("invite=")) {
+        return invite;
+    }
+    return new URL(invite, window.location.origin).searchParams.get("invite");
+}
+
 /**
  * @param {string} roomId
+ * @param {string} inviteId
  */
-async function joinRoom(roomId) {
-    await fetch("/api/rooms/join", {
+async function joinRoom(roomId, inviteId) {
+    const res = await fetch("/api/rooms/join", {
         method: "POST",
         headers: {
             "content-type": "application/json",
         },
         body: JSON.stringify({
             roomId: roomId,
+            inviteId: inviteId,
         }),
     });
+    return await res.json();
 }
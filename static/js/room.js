@@ -2,25 +2,182 @@
 
 /**
  * @typedef {Object} Message
+ * @property {string} messageId
+ * @property {string} [clientId]
  * @property {string} roomId
  * @property {string} userId
  * @property {string} username
  * @property {string} body
  * @property {string} timestamp
+ * @property {string} [editedAt]
+ * @property {string} [deletedAt]
+ * @property {string} [parentId]
+ * @property {string} [parentUsername]
+ * @property {string} [parentBody]
+ * @property {number} replyCount
+ * @property {Reaction[] | null} reactions
  */
 
-import { registerLogoutButton } from "./functions.js";
+/**
+ * @typedef {Object} Reaction
+ * @property {string} emoji
+ * @property {number} count
+ * @property {string[]} userIds
+ */
+
+/**
+ * @typedef {Object} ReactionPayload
+ * @property {string} roomId
+ * @property {string} messageId
+ * @property {string} userId
+ * @property {string} emoji
+ */
+
+/**
+ * @typedef {Object} Frame
+ * @property {number} v
+ * @property {string} type
+ * @property {string} [id]
+ * @property {any} [payload]
+ */
+
+/**
+ * @typedef {Object} AckPayload
+ * @property {string} clientId
+ * @property {string} messageId
+ * @property {string} timestamp
+ */
+
+/**
+ * @typedef {Object} PendingMessage
+ * @property {Object} payload
+ * @property {string} frameId
+ * @property {number} attempts
+ * @property {number} timer
+ */
+
+/**
+ * @typedef {Object} TypingPayload
+ * @property {string} roomId
+ * @property {string} [userId]
+ * @property {string} [username]
+ * @property {boolean} typing
+ */
+
+/**
+ * @typedef {Object} PresencePayload
+ * @property {string} [userId]
+ * @property {string} [username]
+ * @property {"online" | "away" | "offline"} presence
+ */
+
+/**
+ * @typedef {Object} Member
+ * @property {string} userId
+ * @property {string} username
+ * @property {string} role
+ * @property {"online" | "away" | "offline"} presence
+ * @property {string | null} lastSeenAt
+ */
+
+/**
+ * @typedef {Object} MembershipPayload
+ * @property {string} roomId
+ * @property {string} userId
+ */
+
+/**
+ * @typedef {Object} RoomPayload
+ * @property {string} roomId
+ * @property {string} [name]
+ */
+
+/**
+ * @typedef {Object} ErrorPayload
+ * @property {string} code
+ * @property {string} message
+ * @property {number} [retryAfter] milliseconds to wait when throttled or muted
+ */
+
+import {
+    CLIENT_ID,
+    CLOSE_KICKED,
+    CLOSE_LOGGED_OUT,
+    CLOSE_REPLACED,
+    registerLogoutButton,
+} from "./functions.js";
 
 registerLogoutButton();
 
 const roomId = document.URL.split("/").pop();
+const userId = document.querySelector('meta[name="user-id"]').content;
 
 const leaveRoomButton = document.getElementById("leave-room-button");
-leaveRoomButton.onclick = async (event) => {
+if (leaveRoomButton) {
+    leaveRoomButton.onclick = async (event) => {
+        event.preventDefault();
+        await leaveRoom();
+    };
+}
+
+const roomName = document.getElementById("room-name");
+
+const renameRoomButton = document.getElementById("rename-room-button");
+if (renameRoomButton) {
+    renameRoomButton.onclick = async (event) => {
+        event.preventDefault();
+        const name = prompt("Room name", roomName.textContent.trim());
+        if (name) {
+            await renameRoom(name);
+        }
+    };
+}
+
+const INVITE_EXPIRY_SECONDS = 7 * 24 * 60 * 60;
+
+const roomVisibilitySelect = document.getElementById("room-visibility");
+if (roomVisibilitySelect) {
+    roomVisibilitySelect.onchange = async () => {
+        await updateVisibility(roomVisibilitySelect.value);
+    };
+}
+
+const inviteButton = document.getElementById("invite-button");
+if (inviteButton) {
+    inviteButton.onclick = async (event) => {
+        event.preventDefault();
+        await createInvite();
+    };
+}
+
+const joinRequests = document.getElementById("join-requests");
+const joinRequestsList = document.getElementById("join-requests-list");
+const joinRequestTemplate = document.getElementById("join-request-template");
+if (joinRequests) {
+    loadJoinRequests();
+}
+
+const deleteRoomButton = document.getElementById("delete-room-button");
+if (deleteRoomButton) {
+    deleteRoomButton.onclick = async (event) => {
+        event.preventDefault();
+        if (confirm("Delete this room for everyone?")) {
+            await deleteRoom();
+        }
+    };
+}
+
+const replyPreview = document.getElementById("reply-preview");
+const replyPreviewText = document.getElementById("reply-preview-text");
+const replyCancelButton = document.getElementById("reply-cancel");
+replyCancelButton.onclick = (event) => {
     event.preventDefault();
-    await leaveRoom();
+    setReplyTo(null);
 };
 
+/** @type {string | null} */
+let replyToId = null;
+
 const messageBox = document.getElementById("message-box");
 messageBox.onsubmit = (event) => {
     event.preventDefault();
@@ -28,46 +185,259 @@ messageBox.onsubmit = (event) => {
     const body = formData.get("body");
     sendMessage(body);
     messageBox.reset();
+    // the server clears the indicator once the message is saved
+    clearTimeout(typingIdleTimeout);
+    typingSentAt = 0;
 };
 
-const messages = document.getElementById("messages");
-messages.scrollTop = messages.scrollHeight;
+// typing starts are refreshed well within the server's expiry
+const TYPING_REFRESH = 3000;
+const TYPING_IDLE = 3000;
 
-const messageTemplate = document.getElementById("message-template");
+let typingSentAt = 0;
+let typingIdleTimeout = 0;
 
-const closeModalTemplate = document.getElementById("ws-closed-modal");
+messageBox.elements.namedItem("body").oninput = () => {
+    const now = Date.now();
+    if (now - typingSentAt > TYPING_REFRESH) {
+        sendTyping(true);
+        typingSentAt = now;
+    }
+    clearTimeout(typingIdleTimeout);
+    typingIdleTimeout = setTimeout(() => {
+        sendTyping(false);
+        typingSentAt = 0;
+    }, TYPING_IDLE);
+};
+
+/** @type {Map<string, string>} */
+const typingUsers = new Map();
 
-const ws = new WebSocket(wsURL());
-ws.onopen = (event) => {
-    console.log("onopen", event);
+const PRESENCE_CLASSES = {
+    online: "bg-green-600",
+    away: "bg-yellow-600",
+    offline: "bg-stone-600",
 };
-ws.onmessage = (event) => {
-    /** @type Message */
-    const message = JSON.parse(event.data);
-    /** @type HTMLElement */
-    const messageElement = messageTemplate.content.cloneNode(true);
-    // prettier-ignore
-    {
-    messageElement.querySelector("#message-template-username").textContent = message.username;
-    messageElement.querySelector("#message-template-body").textContent = message.body;
-    messageElement.querySelector("#message-template-timestamp").textContent = new Date(message.timestamp).toLocaleString();
-    }
-    messages.appendChild(messageElement);
-    messages.lastElementChild.scrollIntoView({
-        behavior: "smooth",
-        block: "end",
-    });
+
+/** @type {Map<string, Member>} */
+const members = new Map();
+
+const roster = document.getElementById("roster");
+const rosterCount = document.getElementById("roster-count");
+const rosterMemberTemplate = document.getElementById("roster-member-template");
+
+document.onvisibilitychange = () => {
+    sendPresence(document.hidden ? "away" : "online");
+    markRead();
 };
-ws.onerror = (event) => {
-    console.log("onerror", event);
+
+const READ_SCROLL_THRESHOLD = 50;
+
+/** @type {string} */
+let lastReadMessageId = "";
+
+const typingIndicator = document.getElementById("typing-indicator");
+
+const HISTORY_SCROLL_THRESHOLD = 50;
+
+const messages = document.getElementById("messages");
+messages.scrollTop = messages.scrollHeight;
+messages.onscroll = async () => {
+    markRead();
+    if (messages.scrollTop < HISTORY_SCROLL_THRESHOLD) {
+        await loadOlderMessages();
+    }
 };
-ws.onclose = (event) => {
-    console.log("onclose", event);
-    const htmlElement = document.getElementsByTagName("body");
-    const closeModal = closeModalTemplate.content.cloneNode(true);
-    htmlElement.item(0).appendChild(closeModal);
+
+messages.onclick = (event) => {
+    /** @type HTMLElement */
+    const target = event.target;
+    const messageElement = target.closest("[data-message-id]");
+    if (!messageElement) {
+        return;
+    }
+    const messageId = messageElement.dataset.messageId;
+    const reactionElement = target.closest("[data-reaction]");
+    if (reactionElement) {
+        toggleReaction(messageId, reactionElement.dataset.reaction);
+    } else if (target.closest("[data-message-react]")) {
+        const emoji = prompt("React with");
+        if (emoji) {
+            toggleReaction(messageId, emoji.trim());
+        }
+    } else if (target.closest("[data-message-reply]")) {
+        setReplyTo(messageElement);
+    } else if (target.closest("[data-message-thread]")) {
+        openThread(messageId);
+    } else if (target.closest("[data-message-edit]")) {
+        const body = messageElement.querySelector("[data-message-body]");
+        const newBody = prompt("Edit message", body.textContent.trim());
+        if (newBody) {
+            sendFrame("message.edit", { messageId: messageId, body: newBody });
+        }
+    } else if (target.closest("[data-message-delete]")) {
+        if (confirm("Delete message?")) {
+            sendFrame("message.delete", { messageId: messageId });
+        }
+    } else if (target.closest("[data-message-seen]")) {
+        showSeenBy(messageId);
+    }
 };
 
+/** @type Map<string, Map<string, Set<string>>> */
+const reactionsByMessageId = new Map();
+for (const messageElement of messages.querySelectorAll("[data-message-id]")) {
+    /** @type Map<string, Set<string>> */
+    const reactions = new Map();
+    for (const reactionElement of messageElement.querySelectorAll(
+        "[data-reaction]",
+    )) {
+        const userIds = reactionElement.dataset.userIds.trim().split(" ");
+        reactions.set(reactionElement.dataset.reaction, new Set(userIds));
+    }
+    reactionsByMessageId.set(messageElement.dataset.messageId, reactions);
+    renderReactions(messageElement);
+}
+
+let hasMoreHistory = messages.dataset.hasMore === "true";
+let loadingHistory = false;
+
+const messageTemplate = document.getElementById("message-template");
+
+const threadDialogTemplate = document.getElementById("thread-dialog");
+
+const closeModalTemplate = document.getElementById("ws-closed-modal");
+
+const PROTOCOL_VERSION = 1;
+const ACK_TIMEOUT = 5000;
+const RETRY_WAIT = 1000;
+const MAX_SEND_ATTEMPTS = 5;
+
+/** @type Map<string, PendingMessage> */
+const pendingMessages = new Map();
+
+const RECONNECT_WAIT = 500;
+const MAX_RECONNECT_WAIT = 10000;
+const MAX_RECONNECT_ATTEMPTS = 10;
+
+/** @type Set<string> */
+const renderedMessageIds = new Set();
+for (const messageElement of messages.querySelectorAll("[data-message-id]")) {
+    renderedMessageIds.add(messageElement.dataset.messageId);
+}
+
+let lastMessageId = messages.lastElementChild?.dataset.messageId ?? "";
+let reconnectAttempts = 0;
+let leaving = false;
+
+/** @type WebSocket */
+let ws = connect();
+
+function connect() {
+    const ws = new WebSocket(wsURL());
+    ws.onopen = (event) => {
+        console.log("onopen", event);
+        reconnectAttempts = 0;
+        loadRoster();
+        if (document.hidden) {
+            sendPresence("away");
+        }
+        for (const clientId of pendingMessages.keys()) {
+            trySend(clientId);
+        }
+    };
+    ws.onmessage = (event) => {
+        /** @type Frame */
+        const frame = JSON.parse(event.data);
+        switch (frame.type) {
+            case "message.new":
+                renderMessage(frame.payload);
+                markRead();
+                break;
+            case "message.edited":
+            case "message.deleted":
+                updateMessage(frame.payload);
+                break;
+            case "reaction.added":
+            case "reaction.removed":
+                handleReaction(frame.type, frame.payload);
+                break;
+            case "replay.done":
+                handleReplayDone(frame.payload);
+                markRead();
+                break;
+            case "ack":
+                handleAck(frame.payload);
+                break;
+            case "error":
+                handleError(frame);
+                break;
+            case "room.activity":
+                // other rooms are listed on the home page
+                break;
+            case "room.kicked":
+                handleKicked(frame.payload);
+                break;
+            case "room.renamed":
+                handleRenamed(frame.payload);
+                break;
+            case "room.deleted":
+                handleDeleted(frame.payload);
+                break;
+            case "typing":
+                handleTyping(frame.payload);
+                break;
+            case "presence":
+                handlePresence(frame.payload);
+                break;
+            case "read":
+                handleRead(frame.payload);
+                break;
+            case "room.joined":
+            case "room.left":
+                loadRoster();
+                break;
+            default:
+                console.error("unknown frame type", frame);
+        }
+    };
+    ws.onerror = (event) => {
+        console.log("onerror", event);
+    };
+    ws.onclose = (event) => {
+        console.log("onclose", event);
+        // stop frames may be missed while disconnected
+        typingUsers.clear();
+        typingIndicator.textContent = "";
+        if (leaving || event.code === CLOSE_REPLACED) {
+            return;
+        }
+        if (event.code === CLOSE_LOGGED_OUT) {
+            window.location.replace("/");
+            return;
+        }
+        if (event.code === CLOSE_KICKED) {
+            window.location.replace("/home");
+            return;
+        }
+        if (reconnectAttempts >= MAX_RECONNECT_ATTEMPTS) {
+            const htmlElement = document.getElementsByTagName("body");
+            const closeModal = closeModalTemplate.content.cloneNode(true);
+            htmlElement.item(0).appendChild(closeModal);
+            return;
+        }
+        const wait = Math.min(
+            RECONNECT_WAIT * 2 ** reconnectAttempts,
+            MAX_RECONNECT_WAIT,
+        );
+        reconnectAttempts++;
+        setTimeout(() => {
+            ws = connect();
+        }, wait);
+    };
+    return ws;
+}
+
 async function leaveRoom() {
     if (!roomId) {
         console.error("invalid roomId", roomId);
@@ -82,10 +452,638 @@ async function leaveRoom() {
             roomId: roomId,
         }),
     });
+    leaving = true;
     ws.close();
     window.location.replace("/home");
 }
 
+/**
+ * @param {string} name
+ */
+async function renameRoom(name) {
+    const res = await fetch("/api/rooms/rename", {
+        method: "POST",
+        headers: {
+            "content-type": "application/json",
+        },
+        body: JSON.stringify({
+            roomId: roomId,
+            name: name,
+        }),
+    });
+    if (!res.ok) {
+        console.error("error renaming room", await res.json());
+    }
+}
+
+async function deleteRoom() {
+    const res = await fetch("/api/rooms/delete", {
+        method: "POST",
+        headers: {
+            "content-type": "application/json",
+        },
+        body: JSON.stringify({
+            roomId: roomId,
+        }),
+    });
+    if (!res.ok) {
+        console.error("error deleting room", await res.json());
+    }
+}
+
+/**
+ * @param {string} visibility
+ */
+async function updateVisibility(visibility) {
+    const res = await fetch("/api/rooms/visibility", {
+        method: "POST",
+        headers: {
+            "content-type": "application/json",
+        },
+        body: JSON.stringify({
+            roomId: roomId,
+            visibility: visibility,
+        }),
+    });
+    if (!res.ok) {
+        console.error("error updating visibility", await res.json());
+    }
+}
+
+async function createInvite() {
+    const res = await fetch("/api/rooms/invites/create", {
+        method: "POST",
+        headers: {
+            "content-type": "application/json",
+        },
+        body: JSON.stringify({
+            roomId: roomId,
+            expiresIn: INVITE_EXPIRY_SECONDS,
+        }),
+    });
+    const body = await res.json();
+    if (!res.ok) {
+        console.error("error creating invite", body);
+        return;
+    }
+    const url = new URL("/rooms/join", window.location.origin);
+    url.searchParams.set("invite", body.data.invite.inviteId);
+    prompt("Invite link (valid for 7 days)", url.toString());
+}
+
+async function loadJoinRequests() {
+    const res = await fetch(`/api/rooms/${roomId}/requests`);
+    const body = await res.json();
+    if (!res.ok) {
+        console.error("error loading join requests", body);
+        return;
+    }
+    joinRequestsList.replaceChildren();
+    for (const request of body.data.requests) {
+        const element = joinRequestTemplate.content.cloneNode(true);
+        element.querySelector("[data-join-request-username]").textContent =
+            request.username;
+        element.querySelector("[data-join-request-approve]").onclick =
+            async () => {
+                await resolveJoinRequest("approve", request.userId);
+            };
+        element.querySelector("[data-join-request-reject]").onclick =
+            async () => {
+                await resolveJoinRequest("reject", request.userId);
+            };
+        joinRequestsList.appendChild(element);
+    }
+    joinRequests.hidden = body.data.requests.length === 0;
+}
+
+/**
+ * @param {"approve" | "reject"} decision
+ * @param {string} requestUserId
+ */
+async function resolveJoinRequest(decision, requestUserId) {
+    const res = await fetch(`/api/rooms/requests/${decision}`, {
+        method: "POST",
+        headers: {
+            "content-type": "application/json",
+        },
+        body: JSON.stringify({
+            roomId: roomId,
+            userId: requestUserId,
+        }),
+    });
+    if (!res.ok) {
+        console.error("error resolving join request", await res.json());
+    }
+    await loadJoinRequests();
+}
+
+/**
+ * @param {MembershipPayload} membership
+ */
+function handleKicked(membership) {
+    if (membership.roomId !== roomId) {
+        return;
+    }
+    if (membership.userId !== userId) {
+        loadRoster();
+        return;
+    }
+    leaving = true;
+    ws.close();
+    alert("You were removed from this room");
+    window.location.replace("/home");
+}
+
+/**
+ * @param {RoomPayload} room
+ */
+function handleRenamed(room) {
+    if (room.roomId !== roomId) {
+        return;
+    }
+    roomName.textContent = room.name;
+}
+
+/**
+ * @param {RoomPayload} room
+ */
+function handleDeleted(room) {
+    if (room.roomId !== roomId) {
+        return;
+    }
+    leaving = true;
+    ws.close();
+    alert("This room was deleted");
+    window.location.replace("/home");
+}
+
+/**
+ * @param {Message} message
+ */
+function renderMessage(message) {
+    if (message.roomId !== roomId) {
+        return;
+    }
+    if (renderedMessageIds.has(message.messageId)) {
+        return;
+    }
+    renderedMessageIds.add(message.messageId);
+    lastMessageId = message.messageId;
+    if (message.parentId) {
+        incrementReplyCount(message.parentId);
+    }
+    messages.appendChild(createMessageElement(message));
+    messages.lastElementChild.scrollIntoView({
+        behavior: "smooth",
+        block: "end",
+    });
+}
+
+/**
+ * @param {Message} message
+ * @returns {DocumentFragment}
+ */
+function createMessageElement(message) {
+    /** @type DocumentFragment */
+    const messageElement = messageTemplate.content.cloneNode(true);
+    // prettier-ignore
+    {
+    messageElement.querySelector("#message-template-message").dataset.messageId = message.messageId;
+    messageElement.querySelector("#message-template-username").textContent = message.username;
+    messageElement.querySelector("#message-template-body").textContent = message.body;
+    messageElement.querySelector("#message-template-timestamp").textContent = new Date(message.timestamp).toLocaleString();
+    messageElement.querySelector("#message-template-actions").hidden = message.userId !== userId;
+    messageElement.querySelector("#message-template-reply-count").textContent = message.replyCount;
+    messageElement.querySelector("#message-template-thread").hidden = !message.replyCount;
+    }
+    if (message.parentId) {
+        const quote = messageElement.querySelector("#message-template-quote");
+        quote.textContent = `replying to ${message.parentUsername}: ${message.parentBody}`;
+        quote.hidden = false;
+    }
+    /** @type Map<string, Set<string>> */
+    const reactions = new Map();
+    for (const reaction of message.reactions ?? []) {
+        reactions.set(reaction.emoji, new Set(reaction.userIds));
+    }
+    reactionsByMessageId.set(message.messageId, reactions);
+    const element = messageElement.querySelector("#message-template-message");
+    applyMessageState(element, message);
+    renderReactions(element);
+    return messageElement;
+}
+
+/**
+ * @param {string} messageId
+ * @param {string} emoji
+ */
+function toggleReaction(messageId, emoji) {
+    const userIds = reactionsByMessageId.get(messageId)?.get(emoji);
+    const type = userIds?.has(userId) ? "reaction.remove" : "reaction.add";
+    sendFrame(type, { roomId: roomId, messageId: messageId, emoji: emoji });
+}
+
+/**
+ * @param {string} type
+ * @param {ReactionPayload} reaction
+ */
+function handleReaction(type, reaction) {
+    if (reaction.roomId !== roomId) {
+        return;
+    }
+    let reactions = reactionsByMessageId.get(reaction.messageId);
+    if (!reactions) {
+        reactions = new Map();
+        reactionsByMessageId.set(reaction.messageId, reactions);
+    }
+    const userIds = reactions.get(reaction.emoji) ?? new Set();
+    if (type === "reaction.added") {
+        userIds.add(reaction.userId);
+    } else {
+        userIds.delete(reaction.userId);
+    }
+    if (userIds.size === 0) {
+        reactions.delete(reaction.emoji);
+    } else {
+        reactions.set(reaction.emoji, userIds);
+    }
+    const messageElement = messages.querySelector(
+        `[data-message-id="${reaction.messageId}"]`,
+    );
+    if (messageElement) {
+        renderReactions(messageElement);
+    }
+}
+
+/**
+ * @param {HTMLElement} messageElement
+ */
+function renderReactions(messageElement) {
+    const container = messageElement.querySelector("[data-message-reactions]");
+    const reactions = reactionsByMessageId.get(messageElement.dataset.messageId);
+    container.replaceChildren();
+    for (const [emoji, userIds] of reactions ?? []) {
+        const reactionElement = document.createElement("button");
+        reactionElement.className = "py-0.5 px-2 rounded-full bg-stone-700";
+        if (userIds.has(userId)) {
+            reactionElement.classList.add("ring-1", "ring-stone-400");
+        }
+        reactionElement.dataset.reaction = emoji;
+        reactionElement.textContent = `${emoji} ${userIds.size}`;
+        container.appendChild(reactionElement);
+    }
+}
+
+/**
+ * @param {Message} message
+ */
+function updateMessage(message) {
+    if (message.roomId !== roomId) {
+        return;
+    }
+    const messageElement = messages.querySelector(
+        `[data-message-id="${message.messageId}"]`,
+    );
+    if (!messageElement) {
+        return;
+    }
+    messageElement.querySelector("[data-message-body]").textContent =
+        message.body;
+    applyMessageState(messageElement, message);
+}
+
+/**
+ * @param {HTMLElement} messageElement
+ * @param {Message} message
+ */
+function applyMessageState(messageElement, message) {
+    const body = messageElement.querySelector("[data-message-body]");
+    messageElement.querySelector("[data-message-edited]").hidden =
+        !message.editedAt;
+    if (message.deletedAt) {
+        body.textContent = "message deleted";
+        body.classList.add("italic", "text-stone-500");
+        messageElement.querySelector("[data-message-actions]")?.remove();
+    }
+}
+
+/**
+ * @param {string} parentId
+ */
+function incrementReplyCount(parentId) {
+    const parentElement = messages.querySelector(
+        `[data-message-id="${parentId}"]`,
+    );
+    if (!parentElement) {
+        return;
+    }
+    const replyCount = parentElement.querySelector("[data-message-reply-count]");
+    replyCount.textContent = Number(replyCount.textContent) + 1;
+    parentElement.querySelector("[data-message-thread]").hidden = false;
+}
+
+/**
+ * @param {HTMLElement | null} messageElement
+ */
+function setReplyTo(messageElement) {
+    if (!messageElement) {
+        replyToId = null;
+        replyPreview.hidden = true;
+        return;
+    }
+    replyToId = messageElement.dataset.messageId;
+    const body = messageElement.querySelector("[data-message-body]");
+    replyPreviewText.textContent = `replying to: ${body.textContent.trim()}`;
+    replyPreview.hidden = false;
+}
+
+/**
+ * @param {string} messageId
+ */
+async function openThread(messageId) {
+    const res = await fetch(`/api/messages/${messageId}/thread`);
+    const json = await res.json();
+    if (!json.success) {
+        console.error("error loading thread", json.message);
+        return;
+    }
+    /** @type {{parent: Message, replies: Message[]}} */
+    const thread = json.data;
+    /** @type DocumentFragment */
+    const threadDialogFragment = threadDialogTemplate.content.cloneNode(true);
+    const threadDialog = threadDialogFragment.querySelector("dialog");
+    const threadMessages = threadDialog.querySelector("[data-thread-messages]");
+    for (const message of [thread.parent, ...thread.replies]) {
+        const messageElement = createMessageElement(message);
+        messageElement.querySelector("[data-message-quote]").hidden = true;
+        threadMessages.appendChild(messageElement);
+    }
+    threadDialog.querySelector("[data-thread-close]").onclick = () => {
+        threadDialog.close();
+        threadDialog.remove();
+    };
+    document.body.appendChild(threadDialog);
+    threadDialog.showModal();
+}
+
+async function loadOlderMessages() {
+    if (loadingHistory || !hasMoreHistory) {
+        return;
+    }
+    const oldestMessageId = messages.firstElementChild?.dataset.messageId;
+    if (!oldestMessageId) {
+        return;
+    }
+    loadingHistory = true;
+    try {
+        const res = await fetch(
+            `/api/rooms/${roomId}/messages?before=${oldestMessageId}`,
+        );
+        const json = await res.json();
+        if (!json.success) {
+            console.error("error loading messages", json.message);
+            return;
+        }
+        /** @type {{messages: Message[], nextCursor: string | null}} */
+        const page = json.data;
+        const fragment = document.createDocumentFragment();
+        for (const message of page.messages) {
+            if (renderedMessageIds.has(message.messageId)) {
+                continue;
+            }
+            renderedMessageIds.add(message.messageId);
+            fragment.appendChild(createMessageElement(message));
+        }
+        const previousScrollHeight = messages.scrollHeight;
+        messages.prepend(fragment);
+        messages.scrollTop += messages.scrollHeight - previousScrollHeight;
+        hasMoreHistory = page.nextCursor !== null;
+    } finally {
+        loadingHistory = false;
+    }
+}
+
+/**
+ * @param {{roomId: string, truncated: boolean}} replay
+ */
+function handleReplayDone(replay) {
+    if (replay.roomId === roomId && replay.truncated) {
+        window.location.reload();
+    }
+}
+
+/**
+ * @param {AckPayload} ack
+ */
+function handleAck(ack) {
+    const pending = pendingMessages.get(ack.clientId);
+    if (!pending) {
+        return;
+    }
+    clearTimeout(pending.timer);
+    pendingMessages.delete(ack.clientId);
+}
+
+/**
+ * @param {Frame} frame
+ */
+function handleError(frame) {
+    /** @type ErrorPayload */
+    const error = frame.payload;
+    console.error("error", frame.id, error.code, error.message);
+    for (const [clientId, pending] of pendingMessages) {
+        if (pending.frameId !== frame.id) {
+            continue;
+        }
+        clearTimeout(pending.timer);
+        if (error.code === "shutting_down") {
+            // resent once reconnected
+            return;
+        }
+        if (error.code === "rate_limited" || error.code === "muted") {
+            if (error.code === "muted") {
+                alert(`Error sending message: ${error.message}`);
+            }
+            pending.timer = setTimeout(
+                () => trySend(clientId),
+                error.retryAfter ?? RETRY_WAIT,
+            );
+            return;
+        }
+        if (error.code === "save_failed") {
+            pending.timer = setTimeout(() => trySend(clientId), RETRY_WAIT);
+        } else {
+            pendingMessages.delete(clientId);
+            alert(`Error sending message: ${error.message}`);
+        }
+        return;
+    }
+}
+
+/**
+ * @param {string} type
+ * @param {any} payload
+ * @returns {string} the frame ID
+ */
+function sendFrame(type, payload) {
+    const id = crypto.randomUUID();
+    /** @type Frame */
+    const frame = {
+        v: PROTOCOL_VERSION,
+        type: type,
+        id: id,
+        payload: payload,
+    };
+    ws.send(JSON.stringify(frame));
+    return id;
+}
+
+/**
+ * @param {boolean} typing
+ */
+function sendTyping(typing) {
+    if (ws.readyState !== WebSocket.OPEN) {
+        return;
+    }
+    sendFrame("typing", { roomId: roomId, typing: typing });
+}
+
+/**
+ * @param {TypingPayload} typing
+ */
+function handleTyping(typing) {
+    if (typing.roomId !== roomId) {
+        return;
+    }
+    if (typing.typing) {
+        typingUsers.set(typing.userId, typing.username);
+    } else {
+        typingUsers.delete(typing.userId);
+    }
+    const usernames = [...typingUsers.values()];
+    switch (usernames.length) {
+        case 0:
+            typingIndicator.textContent = "";
+            break;
+        case 1:
+            typingIndicator.textContent = `${usernames[0]} is typing…`;
+            break;
+        case 2:
+            typingIndicator.textContent = `${usernames[0]} and ${usernames[1]} are typing…`;
+            break;
+        default:
+            typingIndicator.textContent = "Several people are typing…";
+    }
+}
+
+/**
+ * @param {{roomId: string, messageId: string, userId: string}} read
+ */
+function handleRead(read) {
+    // another tab of ours caught up, so don't re-send the same receipt
+    if (read.roomId === roomId && read.userId === userId) {
+        lastReadMessageId = read.messageId;
+    }
+}
+
+// only counts as read while the latest messages are actually on screen
+function markRead() {
+    if (document.hidden || ws.readyState !== WebSocket.OPEN) {
+        return;
+    }
+    const distanceFromBottom =
+        messages.scrollHeight - messages.scrollTop - messages.clientHeight;
+    if (distanceFromBottom > READ_SCROLL_THRESHOLD) {
+        return;
+    }
+    if (!lastMessageId || lastMessageId === lastReadMessageId) {
+        return;
+    }
+    lastReadMessageId = lastMessageId;
+    sendFrame("read", { roomId: roomId, messageId: lastMessageId });
+}
+
+/**
+ * @param {string} messageId
+ */
+async function showSeenBy(messageId) {
+    const res = await fetch(`/api/messages/${messageId}/seen`);
+    const body = await res.json();
+    if (!res.ok) {
+        console.error("error loading seen by", body);
+        return;
+    }
+    const usernames = body.data.seenBy.map((user) => user.username);
+    alert(
+        usernames.length
+            ? `Seen by ${usernames.join(", ")}`
+            : "Not seen by anyone yet",
+    );
+}
+
+/**
+ * @param {"online" | "away"} presence
+ */
+function sendPresence(presence) {
+    if (ws.readyState !== WebSocket.OPEN) {
+        return;
+    }
+    sendFrame("presence", { presence: presence });
+}
+
+async function loadRoster() {
+    const res = await fetch(`/api/rooms/${roomId}/members`);
+    const body = await res.json();
+    if (!res.ok) {
+        console.error("error loading roster", body);
+        return;
+    }
+    members.clear();
+    for (const member of body.data.members) {
+        members.set(member.userId, member);
+    }
+    renderRoster();
+}
+
+/**
+ * @param {PresencePayload} presence
+ */
+function handlePresence(presence) {
+    const member = members.get(presence.userId);
+    if (!member) {
+        return;
+    }
+    member.presence = presence.presence;
+    member.lastSeenAt = new Date().toISOString();
+    renderRoster();
+}
+
+function renderRoster() {
+    roster.replaceChildren();
+    let online = 0;
+    for (const member of members.values()) {
+        if (member.presence !== "offline") {
+            online++;
+        }
+        const element = rosterMemberTemplate.content.cloneNode(true);
+        element.querySelector("[data-member-id]").dataset.memberId =
+            member.userId;
+        element
+            .querySelector("[data-member-presence]")
+            .classList.add(PRESENCE_CLASSES[member.presence]);
+        element.querySelector("[data-member-username]").textContent =
+            member.username;
+        element.querySelector("[data-member-role]").textContent =
+            member.role === "member" ? "" : member.role;
+        if (member.presence === "offline" && member.lastSeenAt) {
+            element.querySelector("[data-member-last-seen]").textContent =
+                `last seen ${new Date(member.lastSeenAt).toLocaleString()}`;
+        }
+        roster.appendChild(element);
+    }
+    rosterCount.textContent = `(${online}/${members.size} online)`;
+}
+
 /**
  * @param {string} body
  */
@@ -98,13 +1096,41 @@ function sendMessage(body) {
         console.error("empty body", body);
         return;
     }
-    /** @type Message */
-    const message = {
-        roomId: roomId,
-        body: body,
-        timestamp: new Date().toISOString(),
-    };
-    ws.send(JSON.stringify(message));
+    const clientId = crypto.randomUUID();
+    pendingMessages.set(clientId, {
+        payload: {
+            clientId: clientId,
+            roomId: roomId,
+            parentId: replyToId ?? undefined,
+            body: body,
+        },
+        frameId: "",
+        attempts: 0,
+        timer: 0,
+    });
+    setReplyTo(null);
+    trySend(clientId);
+}
+
+/**
+ * resends reuse the client ID so the server saves the message at most once
+ * @param {string} clientId
+ */
+function trySend(clientId) {
+    const pending = pendingMessages.get(clientId);
+    if (!pending) {
+        return;
+    }
+    if (pending.attempts >= MAX_SEND_ATTEMPTS) {
+        pendingMessages.delete(clientId);
+        alert("Error sending message");
+        return;
+    }
+    pending.attempts++;
+    pending.timer = setTimeout(() => trySend(clientId), ACK_TIMEOUT);
+    if (ws.readyState === WebSocket.OPEN) {
+        pending.frameId = sendFrame("message.send", pending.payload);
+    }
 }
 
 function wsURL() {
@@ -112,5 +1138,6 @@ function wsURL() {
     if (document.location.protocol === "https:") {
         scheme += "s";
     }
-    return `${scheme}://${document.location.hostname}:${document.location.port}/api/connect`;
+    const cursor = lastMessageId ? `${roomId}:${lastMessageId}` : roomId;
+    return `${scheme}://${document.location.hostname}:${document.location.port}/api/connect?cursor=${cursor}&client=${CLIENT_ID}`;
 }
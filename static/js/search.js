@@ -0,0 +1,83 @@
+"use strict";
+
+/**
+ * @typedef {Object} SearchResult
+ * @property {string} messageId
+ * @property {string} roomId
+ * @property {string} roomName
+ * @property {string} userId
+ * @property {string} username
+ * @property {string} body
+ * @property {string} headline
+ * @property {number} rank
+ * @property {string} timestamp
+ */
+
+import { registerLogoutButton } from "./functions.js";
+
+registerLogoutButton();
+
+const searchResults = document.getElementById("search-results");
+const searchEmpty = document.getElementById("search-empty");
+const searchMore = document.getElementById("search-more");
+const searchResultTemplate = document.getElementById(
+    "search-result-template",
+);
+
+/** @type {URLSearchParams} */
+let searchParams = new URLSearchParams();
+
+/** @type {number | null} */
+let nextOffset = null;
+
+const searchForm = document.getElementById("search-form");
+searchForm.onsubmit = async (event) => {
+    event.preventDefault();
+    searchParams = new URLSearchParams();
+    for (const [key, value] of new FormData(searchForm)) {
+        if (value) {
+            searchParams.set(key, value);
+        }
+    }
+    nextOffset = null;
+    searchResults.replaceChildren();
+    await search();
+};
+
+searchMore.onclick = async (event) => {
+    event.preventDefault();
+    await search();
+};
+
+async function search() {
+    const url = new URL("/api/search", window.location.origin);
+    url.search = searchParams.toString();
+    if (nextOffset) {
+        url.searchParams.set("offset", nextOffset);
+    }
+    const res = await fetch(url);
+    const body = await res.json();
+    if (!res.ok) {
+        alert(body.message);
+        return;
+    }
+    for (const result of body.data.results) {
+        renderResult(result);
+    }
+    nextOffset = body.data.nextOffset;
+    searchMore.hidden = !nextOffset;
+    searchEmpty.hidden = searchResults.childElementCount > 0;
+}
+
+/**
+ * @param {SearchResult} result
+ */
+function renderResult(result) {
+    const element = searchResultTemplate.content.cloneNode(true);
+    element.querySelector("[data-result-link]").href = `/rooms/${result.roomId}`;
+    element.querySelector("[data-result-meta]").textContent = `${result.username} in ${result.roomName} · ${new Date(result.timestamp).toLocaleString()}`;
+    // the headline is escaped by the server apart from its <mark> tags
+    element.querySelector("[data-result-headline]").innerHTML =
+        result.headline;
+    searchResults.appendChild(element);
+}